@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"time"
+
+	pb "github.com/dhtech/proto/auth"
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/net/context"
+)
+
+var (
+	maxActions     = flag.Int("max_actions", 20, "Give up if the server requires more actions than this in one request")
+	requestTimeout = flag.Duration("request_timeout", time.Minute, "How long to wait for the credentials, including the actions the server requires")
+	actionTypes    = flag.Bool("action_types", false, "Experimental: handle required actions with a prompt:, wait: or info: prefix as prompts and messages instead of pages to open, for auth servers that send them")
+)
+
+// A required action is a page to open in the browser. RequiredAction has no
+// field for other kinds of actions, so with -action_types the auth server may
+// send these prefixes in its URL instead. They are experimental: the auth
+// server protocol does not define them, and a prompted code is posted to the
+// web server without anything binding it to this request. The server has to
+// be configured to send them, which is why they are only handled when asked
+// for.
+const (
+	// prompt:<path> asks for a code, such as a TOTP code, on the terminal
+	// and posts it as the form field "code" to the path on the web server.
+	actionPrompt = "prompt:"
+	// wait:<message> tells that the server waits for something, such as an
+	// approval, and will send more when it is done.
+	actionWait = "wait:"
+	// info:<message> is only shown.
+	actionInfo = "info:"
+)
+
+// actionDispatcher follows the required actions of one credential request.
+type actionDispatcher struct {
+	ctx context.Context
+	// Without a user at a browser and terminal, only waiting is possible.
+	unattended bool
+	onAction   func(url string)
+	count      int
+	seen       map[string]bool
+}
+
+func newActionDispatcher(ctx context.Context, unattended bool, onAction func(url string)) *actionDispatcher {
+	return &actionDispatcher{ctx: ctx, unattended: unattended, onAction: onAction, seen: map[string]bool{}}
+}
+
+// actionMessage returns the message of a wait or info action, which is
+// escaped like the rest of the URL.
+func actionMessage(s string) string {
+	if m, err := neturl.PathUnescape(s); err == nil {
+		return m
+	}
+	return s
+}
+
+// dispatch handles a. The server repeats actions while it waits for them,
+// so an action is only followed the first time it is seen, and only distinct
+// actions count towards -max_actions. Repeats are bounded by
+// -request_timeout.
+func (d *actionDispatcher) dispatch(a *pb.RequiredAction) error {
+	if d.seen[a.Url] {
+		log.Printf("Still waiting for %s", a.Url)
+		return nil
+	}
+	d.count++
+	if d.count > *maxActions {
+		return fmt.Errorf("the server required more than %d actions, giving up", *maxActions)
+	}
+	d.seen[a.Url] = true
+
+	switch {
+	case !*actionTypes:
+		// Every action is a page to open.
+	case strings.HasPrefix(a.Url, actionWait):
+		d.report(a.Url)
+		log.Printf("Waiting: %s", actionMessage(strings.TrimPrefix(a.Url, actionWait)))
+		if dl, ok := d.ctx.Deadline(); ok {
+			log.Printf("Giving up in %v", time.Until(dl).Round(time.Second))
+		}
+		return nil
+	case strings.HasPrefix(a.Url, actionInfo):
+		d.report(a.Url)
+		log.Print(actionMessage(strings.TrimPrefix(a.Url, actionInfo)))
+		return nil
+	case strings.HasPrefix(a.Url, actionPrompt):
+		u := *webUrl + strings.TrimPrefix(a.Url, actionPrompt)
+		d.report(u)
+		if d.unattended {
+			return fmt.Errorf("the server requires a code to be entered: %s", u)
+		}
+		return d.prompt(u)
+	}
+
+	u := *webUrl + a.Url
+	d.report(u)
+	if d.unattended {
+		return fmt.Errorf("the server requires an action that needs a browser: %s", u)
+	}
+	log.Printf("Required action: %s", u)
+	openBrowser(u)
+	return nil
+}
+
+func (d *actionDispatcher) report(u string) {
+	if d.onAction != nil {
+		d.onAction(u)
+	}
+}
+
+// prompt reads a code from the terminal and posts it to u.
+func (d *actionDispatcher) prompt(u string) error {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("the server requires a code to be entered, but there is no terminal")
+	}
+	fmt.Fprint(os.Stderr, "Verification code: ")
+	line := make(chan string, 1)
+	go func() {
+		s, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		line <- strings.TrimSpace(s)
+	}()
+	var code string
+	select {
+	case code = <-line:
+	case <-d.ctx.Done():
+		fmt.Fprintln(os.Stderr)
+		return fmt.Errorf("no code entered: %v", d.ctx.Err())
+	}
+	if code == "" {
+		return fmt.Errorf("no code entered")
+	}
+
+	req, err := http.NewRequest("POST", u, strings.NewReader(neturl.Values{"code": {code}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r, err := http.DefaultClient.Do(req.WithContext(d.ctx))
+	if err != nil {
+		return fmt.Errorf("could not submit code: %v", err)
+	}
+	r.Body.Close()
+	if r.StatusCode/100 != 2 {
+		return fmt.Errorf("could not submit code: %s", r.Status)
+	}
+	return nil
+}
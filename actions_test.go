@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	pb "github.com/dhtech/proto/auth"
+	"golang.org/x/net/context"
+)
+
+// withActionTypes sets -action_types until the returned function is called.
+func withActionTypes(v bool) func() {
+	old := *actionTypes
+	*actionTypes = v
+	return func() { *actionTypes = old }
+}
+
+func TestDispatchRepeatedAction(t *testing.T) {
+	defer withActionTypes(true)()
+	reported := []string{}
+	d := newActionDispatcher(context.Background(), true, func(u string) { reported = append(reported, u) })
+
+	for i := 0; i < *maxActions*2; i++ {
+		if err := d.dispatch(&pb.RequiredAction{Url: "wait:approval"}); err != nil {
+			t.Fatalf("repeat %d: %v", i, err)
+		}
+	}
+	if len(reported) != 1 {
+		t.Errorf("repeated action reported %d times, want once", len(reported))
+	}
+}
+
+func TestDispatchMaxActions(t *testing.T) {
+	defer withActionTypes(true)()
+	old := *maxActions
+	defer func() { *maxActions = old }()
+	*maxActions = 2
+	d := newActionDispatcher(context.Background(), true, nil)
+
+	for _, u := range []string{"info:one", "info:two"} {
+		if err := d.dispatch(&pb.RequiredAction{Url: u}); err != nil {
+			t.Fatalf("%s: %v", u, err)
+		}
+	}
+	if err := d.dispatch(&pb.RequiredAction{Url: "info:three"}); err == nil {
+		t.Error("third distinct action accepted with -max_actions 2")
+	}
+}
+
+func TestDispatchUnattended(t *testing.T) {
+	for _, c := range []struct {
+		types bool
+		url   string
+	}{
+		{false, "/login"},
+		{true, "/login"},
+		{true, "prompt:/totp"},
+	} {
+		restore := withActionTypes(c.types)
+		d := newActionDispatcher(context.Background(), true, nil)
+		err := d.dispatch(&pb.RequiredAction{Url: c.url})
+		if err == nil || !strings.Contains(err.Error(), *webUrl) {
+			t.Errorf("unattended %s with -action_types=%v: %v, want an error with the URL", c.url, c.types, err)
+		}
+		restore()
+	}
+}
+
+func TestDispatchPrefixesNeedActionTypes(t *testing.T) {
+	defer withActionTypes(false)()
+	d := newActionDispatcher(context.Background(), true, nil)
+	// Without -action_types, wait: is a page to open, which fails unattended.
+	if err := d.dispatch(&pb.RequiredAction{Url: "wait:approval"}); err == nil {
+		t.Error("wait: handled as a message without -action_types")
+	}
+}
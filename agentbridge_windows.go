@@ -0,0 +1,58 @@
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dhtech/prodaccess/pageant"
+)
+
+const (
+	opensshAgentPipe = `\\.\pipe\openssh-ssh-agent`
+)
+
+// agentBridge relays agent messages between stdin/stdout and a Windows SSH
+// agent. It is run by prodaccess inside WSL, which cannot reach Pageant or
+// the OpenSSH agent pipe by itself.
+func agentBridge(backend string) error {
+	var a io.ReadWriter
+	switch backend {
+	case "pageant":
+		if !pageant.Available() {
+			return pageant.ErrPageantNotFound
+		}
+		a = pageant.NewConn()
+	case "openssh":
+		f, err := os.OpenFile(opensshAgentPipe, os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("could not connect to the OpenSSH agent: %v", err)
+		}
+		defer f.Close()
+		a = f
+	default:
+		return fmt.Errorf("unknown agent %q, expected pageant or openssh", backend)
+	}
+
+	for {
+		msg, err := pageant.ReadMessage(os.Stdin)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := a.Write(msg); err != nil {
+			return err
+		}
+		resp, err := pageant.ReadMessage(a)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stdout.Write(resp); err != nil {
+			return err
+		}
+	}
+}
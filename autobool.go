@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+)
+
+// autoBool is a boolean flag that can also be left to "auto", letting
+// prodaccess detect the right value. It accepts the bare -name form so that
+// it is a drop-in replacement for flag.Bool.
+type autoBool struct {
+	set   bool
+	value bool
+}
+
+func newAutoBool(name string, usage string) *autoBool {
+	b := &autoBool{}
+	flag.Var(b, name, usage)
+	return b
+}
+
+// Get returns the explicitly configured value and whether there was one.
+func (b *autoBool) Get() (bool, bool) {
+	return b.value, b.set
+}
+
+func (b *autoBool) Set(s string) error {
+	if s == "auto" {
+		b.set = false
+		b.value = false
+		return nil
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	b.set = true
+	b.value = v
+	return nil
+}
+
+func (b *autoBool) String() string {
+	if b == nil || !b.set {
+		return "auto"
+	}
+	return strconv.FormatBool(b.value)
+}
+
+func (b *autoBool) IsBoolFlag() bool {
+	return true
+}
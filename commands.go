@@ -0,0 +1,454 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var (
+	// Set at build time with -ldflags "-X main.version=..."
+	version = "devel"
+)
+
+// command is a prodaccess subcommand. All commands share the global flags,
+// which may be given before or after the command name.
+type command struct {
+	name    string
+	args    string
+	summary string
+	help    string
+	// Helper commands are run by other programs rather than by users.
+	helper bool
+	// Set for the commands that honor -dry_run, or change nothing anyway.
+	dryRun bool
+	// Set for the commands that cannot print a JSON document on stdout.
+	textOnly bool
+	// flags registers the options only this command takes.
+	flags func(fs *flag.FlagSet)
+	run   func(args []string) error
+}
+
+var (
+	daemonInterval = new(time.Duration)
+	fetchSSH       = new(string)
+	fetchVault     = new(string)
+	fetchKube      = new(string)
+	offlineIn      = new(string)
+	offlineOut     = new(string)
+	offlinePending = new(string)
+
+	commands = []*command{
+		{
+			name:    "login",
+			dryRun:  true,
+			summary: "Request and install credentials (default)",
+			help: `Logs in through the browser and installs an SSH certificate, a Vault
+token and, depending on the options and what is detected, Kubernetes,
+VMware and browser certificates. Credentials that are valid for longer than
+-renew_before are kept unless -force is given, and if all of them are no
+login is needed.`,
+			run: func(args []string) error {
+				return loginCommand()
+			},
+		},
+		{
+			name:    "renew",
+			dryRun:  true,
+			summary: "Request new credentials for the ones installed",
+			help: `Logs in again, requesting only the kinds of credentials that are
+installed already, whether they have expired or not.`,
+			run: func(args []string) error {
+				return renew()
+			},
+		},
+		{
+			name:    "status",
+			dryRun:  true,
+			summary: "Show installed credentials and when they expire",
+			run: func(args []string) error {
+				if jsonOutput() {
+					return writeJSON(credentialStatuses())
+				}
+				printStatus(os.Stdout, credentialStatuses())
+				return nil
+			},
+		},
+		{
+			name:    "env",
+			dryRun:  true,
+			summary: "Print shell commands that point programs at the credentials",
+			help: `Prints statements setting VAULT_TOKEN, KUBECONFIG, SSH_AUTH_SOCK and the
+paths of the certificates for the active profile, in the syntax of -shell.
+Use it as:
+
+  eval "$(prodaccess env)"                         # bash, zsh
+  prodaccess env | source                          # fish
+  prodaccess env | Out-String | Invoke-Expression  # PowerShell
+
+With -export_env, login prints the same after logging in.`,
+			run: func(args []string) error {
+				if jsonOutput() {
+					return writeJSON(envMap(environment()))
+				}
+				return printEnv(os.Stdout, detectShell(), environment())
+			},
+		},
+		{
+			name:     "shell",
+			textOnly: true,
+			summary:  "Start a shell with credentials only it can use",
+			help: `Logs in for a new SSH key held by an SSH agent of its own, writes the
+Vault token, kubeconfig and SSH certificate to a temporary directory and
+starts $SHELL with the environment pointing there. Everything is removed
+when the shell exits. Browser and VMware certificates are not requested.
+The SSH CA is added to $PRODACCESS_SESSION/known_hosts instead of
+~/.ssh/known_hosts, and nothing outside the session is cleaned up. Run ssh
+as "ssh -F $PRODACCESS_SESSION/ssh_config" to trust it, git does so
+through $GIT_SSH_COMMAND.`,
+			run: func(args []string) error {
+				return session(nil)
+			},
+		},
+		{
+			name:     "exec",
+			textOnly: true,
+			args:     "-- command [args...]",
+			summary:  "Run a command with credentials only it can use",
+			help:     `Like shell, but runs the command instead and exits with its exit status.`,
+			run: func(args []string) error {
+				if len(args) == 0 {
+					return fmt.Errorf("expected a command to run")
+				}
+				return session(args)
+			},
+		},
+		{
+			name:    "fetch",
+			summary: "Write credentials to files or stdout without installing them",
+			help: `Requests the credentials that an output is given for and writes them as
+they are, "-" means stdout. The Kubernetes certificate is written together
+with its key. Meant for CI jobs, which can authenticate with a service
+account using -auth_token_file, $PRODACCESS_AUTH_TOKEN or -client_cert
+instead of the browser. A request that needs a browser then fails.`,
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(fetchSSH, "ssh_out", "", "Where to write the SSH certificate")
+				fs.StringVar(fetchVault, "vault_out", "", "Where to write the Vault token")
+				fs.StringVar(fetchKube, "kube_out", "", "Where to write the Kubernetes certificate and key")
+			},
+			run: func(args []string) error {
+				return fetch(*fetchSSH, *fetchVault, *fetchKube)
+			},
+		},
+		{
+			name:    "request",
+			summary: "Write a credential request for a machine without access to the auth server",
+			help: `Generates keys and writes the request login would send to -out. Carry it
+to a machine that can reach the auth server and run submit there, then
+bring the response back and run install. The private keys never leave
+this machine, they are kept in -pending until install. The exception is
+the Kubernetes key, which the auth server generates and sends with the
+certificate, so the response holds it. install only accepts a response
+for the request in -pending.`,
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(offlineOut, "out", "", "Where to write the request")
+				fs.StringVar(offlinePending, "pending", defaultPendingRequest(), "Where to keep the private keys until install")
+			},
+			run: func(args []string) error {
+				if *offlineOut == "" {
+					return fmt.Errorf("-out is required")
+				}
+				return requestOffline(*offlineOut, *offlinePending)
+			},
+		},
+		{
+			name:    "submit",
+			summary: "Send a request written by request and save the response",
+			help: `Logs in through the browser with the request in -in, made by request on
+another machine, and writes the issued credentials to -out for install.`,
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(offlineIn, "in", "", "Request to send")
+				fs.StringVar(offlineOut, "out", "", "Where to write the response")
+			},
+			run: func(args []string) error {
+				if *offlineIn == "" || *offlineOut == "" {
+					return fmt.Errorf("-in and -out are required")
+				}
+				return submit(*offlineIn, *offlineOut)
+			},
+		},
+		{
+			name:    "install",
+			summary: "Install credentials from a response saved by submit",
+			help: `Checks that the credentials in -in were issued for the keys of the
+request made here and installs them like login does.`,
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(offlineIn, "in", "", "Response to install")
+				fs.StringVar(offlinePending, "pending", defaultPendingRequest(), "Private keys kept by request")
+			},
+			run: func(args []string) error {
+				if *offlineIn == "" {
+					return fmt.Errorf("-in is required")
+				}
+				return installOffline(*offlineIn, *offlinePending)
+			},
+		},
+		{
+			name:    "logout",
+			summary: "Remove all installed credentials",
+			help: `Removes the Vault token and every prodaccess issued certificate from
+the files, SSH agent, kubeconfig and certificate stores it was installed
+into.`,
+			run: func(args []string) error {
+				logout()
+				return printRemovals()
+			},
+		},
+		{
+			name:     "daemon",
+			textOnly: true,
+			summary:  "Keep credentials renewed",
+			help: `Checks the installed credentials periodically and renews them when one
+expires within -renew_before. Renewing requires logging in through the
+browser. Like any other prodaccess, the daemon is stopped when a new login
+is started.`,
+			flags: func(fs *flag.FlagSet) {
+				fs.DurationVar(daemonInterval, "interval", 5*time.Minute, "How often to check the installed credentials")
+			},
+			run: func(args []string) error {
+				return daemon(*daemonInterval)
+			},
+		},
+		{
+			name:    "doctor",
+			dryRun:  true,
+			summary: "Check that everything prodaccess needs is in place",
+			help: `Checks the SSH key and agent, the ident server port, the connection to
+the auth server, the clock and the tools used to install credentials, and
+tells how to fix what is missing. Exits with an error if a check failed,
+warnings are printed for what only limits which credentials can be used.`,
+			run: func(args []string) error {
+				return doctor(os.Stdout)
+			},
+		},
+		{
+			name:    "version",
+			dryRun:  true,
+			summary: "Print the prodaccess version",
+			run: func(args []string) error {
+				if jsonOutput() {
+					return writeJSON(map[string]string{
+						"version":  version,
+						"os":       runtime.GOOS,
+						"arch":     runtime.GOARCH,
+						"compiler": runtime.Version(),
+					})
+				}
+				fmt.Printf("prodaccess %s %s/%s %s\n", version, runtime.GOOS, runtime.GOARCH, runtime.Version())
+				return nil
+			},
+		},
+		{
+			name:    "gc",
+			summary: "Remove expired credentials",
+			help:    `Removes expired prodaccess issued certificates, this is also done after every login.`,
+			run: func(args []string) error {
+				garbageCollect()
+				return printRemovals()
+			},
+		},
+		{
+			name:    "kube-credential",
+			summary: "Kubernetes exec credential plugin",
+			help: `Prints a client-go ExecCredential, renewing the cached Kubernetes
+certificate if needed. Configured in kubeconfig by login with -kube_exec.`,
+			helper: true,
+			run: func(args []string) error {
+				return kubeCredential()
+			},
+		},
+		{
+			name:    "agent-bridge",
+			args:    "pageant|openssh",
+			summary: "Relay SSH agent messages from WSL to a Windows agent",
+			help: `Relays agent messages on stdin and stdout to Pageant or the Windows
+OpenSSH agent. Run from WSL by login with -wsl_ssh_agent.`,
+			helper: true,
+			run: func(args []string) error {
+				if len(args) != 1 {
+					return fmt.Errorf("expected the agent to relay to")
+				}
+				return agentBridge(args[0])
+			},
+		},
+	}
+)
+
+// exitStatus makes a command exit with the given status without it being
+// logged as a failure.
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// commandFlagSet returns the options of c, which are its own and the global
+// flags, since those may be repeated after the command name.
+func commandFlagSet(c *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	if c.flags != nil {
+		c.flags(fs)
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) == nil {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	return fs
+}
+
+// commandFlags returns the names of the options only some command takes.
+// Registering them sets them to their defaults, so this must be called
+// before the command line is parsed.
+func commandFlags() map[string]bool {
+	names := map[string]bool{}
+	for _, c := range commands {
+		if c.flags == nil {
+			continue
+		}
+		fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		c.flags(fs)
+		fs.VisitAll(func(f *flag.Flag) {
+			names[f.Name] = true
+		})
+	}
+	return names
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func usage() {
+	o := flag.CommandLine.Output()
+	fmt.Fprintf(o, "Usage: prodaccess [options] [command] [command options]\n\nCommands:\n")
+	for _, c := range commands {
+		if !c.helper {
+			fmt.Fprintf(o, "  %-16s %s\n", c.name, c.summary)
+		}
+	}
+	fmt.Fprintf(o, "\nHelper commands:\n")
+	for _, c := range commands {
+		if c.helper {
+			fmt.Fprintf(o, "  %-16s %s\n", c.name, c.summary)
+		}
+	}
+	fmt.Fprintf(o, "\nRun \"prodaccess help <command>\" for details on a command.\n")
+	fmt.Fprintf(o, `
+Exit status:
+  %d  Success, every credential is installed or still valid
+  %d  Failure, nothing was installed
+  %d  Invalid command line
+  %d  Some credentials were not issued, the others are installed
+  %d  Some credentials could not be installed, takes precedence over %d
+`, 0, exitFailed, exitUsage, exitNotIssued, exitInstallFailed, exitNotIssued)
+	fmt.Fprintf(o, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func commandUsage(c *command) {
+	o := flag.CommandLine.Output()
+	fmt.Fprintf(o, "Usage: %s\n\n%s\n", strings.TrimSpace("prodaccess [options] "+c.name+" [command options] "+c.args), c.summary)
+	if c.help != "" {
+		fmt.Fprintf(o, "\n%s\n", c.help)
+	}
+	if c.flags != nil {
+		own := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		c.flags(own)
+		own.SetOutput(o)
+		fmt.Fprintf(o, "\nCommand options:\n")
+		own.PrintDefaults()
+	}
+	fmt.Fprintf(o, "\nRun \"prodaccess -help\" for the options shared by all commands.\n")
+}
+
+// runCommand runs the command named by the first argument and returns the
+// exit code.
+func runCommand(args []string) int {
+	name := "login"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+
+	if name == "help" {
+		if len(args) == 0 {
+			usage()
+			return 0
+		}
+		c := findCommand(args[0])
+		if c == nil {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+			return exitUsage
+		}
+		commandUsage(c)
+		return 0
+	}
+
+	c := findCommand(name)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		return exitUsage
+	}
+
+	others := commandFlags()
+	fs := commandFlagSet(c)
+	fs.Usage = func() { commandUsage(c) }
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return exitUsage
+	}
+	fs.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+
+	if err := applyConfig(fs, others); err != nil {
+		log.Printf("could not load configuration: %v", err)
+		writeJSONError(fmt.Errorf("could not load configuration: %v", err))
+		return exitFailed
+	}
+	if err := checkOutputFormat(); err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	if jsonOutput() && c.textOnly {
+		log.Printf("%s does not support -output=json", c.name)
+		return exitUsage
+	}
+	if *dryRun && !c.dryRun {
+		log.Printf("%s does not support -dry_run", c.name)
+		return exitUsage
+	}
+
+	if err := c.run(fs.Args()); err != nil {
+		writeJSONError(err)
+		if e, ok := err.(exitStatus); ok {
+			return int(e)
+		}
+		log.Printf("%s failed: %v", c.name, err)
+		return exitFailed
+	}
+	return 0
+}
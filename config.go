@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	configPath  = flag.String("config", "", "Configuration file, defaults to $PRODACCESS_CONFIG, or prodaccess/config.yaml in the user config directory or else the system one")
+	profileName = flag.String("profile", "", "Configuration profile to use, defaults to $PRODACCESS_PROFILE or default_profile from the configuration")
+
+	// Flags given on the command line, these take precedence over the profile.
+	explicitFlags = map[string]bool{}
+	// The profile in use, if any.
+	activeProfile = ""
+	// The configuration an installation ships, such as the Kubernetes
+	// cluster every user needs.
+	systemConfig = systemConfigPath()
+)
+
+// config is the configuration file. A profile maps option names, global or
+// of a command, to values, for example:
+//
+//	default_profile: production
+//	profiles:
+//	  production: {}
+//	  staging:
+//	    grpc: auth-staging.tech.dreamhack.se:443
+//	    server_name: auth-staging.tech.dreamhack.se
+//	    web: https://auth-staging.tech.dreamhack.se
+//	    vault_token: $HOME/.vault-token-staging
+//	    kubernetes: false
+//	  ci:
+//	    ssh: false
+//	    vault_out: /run/secrets/vault-token
+type config struct {
+	DefaultProfile string                            `json:"default_profile"`
+	Profiles       map[string]map[string]interface{} `json:"profiles"`
+}
+
+// defaultConfigPaths returns the configuration files used without -config,
+// the first one that exists is read.
+func defaultConfigPaths() []string {
+	if p := os.Getenv("PRODACCESS_CONFIG"); p != "" {
+		return []string{p}
+	}
+	ps := []string{}
+	if d, err := os.UserConfigDir(); err == nil {
+		ps = append(ps, filepath.Join(d, "prodaccess", "config.yaml"))
+	}
+	return append(ps, systemConfig)
+}
+
+func systemConfigPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "prodaccess", "config.yaml")
+	}
+	return "/etc/prodaccess/config.yaml"
+}
+
+// applyConfig sets every option in fs not given on the command line from
+// the selected profile. It must be called after fs is parsed. A profile may
+// also set the options of other commands, which are in others.
+func applyConfig(fs *flag.FlagSet, others map[string]bool) error {
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+
+	cp := *configPath
+	var b []byte
+	var err error
+	if cp != "" {
+		if b, err = ioutil.ReadFile(os.ExpandEnv(cp)); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range defaultConfigPaths() {
+			b, err = ioutil.ReadFile(os.ExpandEnv(p))
+			if err == nil {
+				cp = p
+				break
+			}
+			if !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	cfg := config{}
+	if cp != "" {
+		if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+			return fmt.Errorf("could not parse %s: %v", cp, err)
+		}
+	}
+
+	name := *profileName
+	if name == "" {
+		name = os.Getenv("PRODACCESS_PROFILE")
+	}
+	if name == "" {
+		name = cfg.DefaultProfile
+	}
+	if name == "" {
+		return nil
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return fmt.Errorf("no profile %q in %q", name, cp)
+	}
+
+	keys := []string{}
+	for k := range p {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if explicitFlags[k] {
+			continue
+		}
+		if k == "config" || k == "profile" {
+			return fmt.Errorf("profile %q cannot set %q", name, k)
+		}
+		if fs.Lookup(k) == nil {
+			if others[k] {
+				continue
+			}
+			return fmt.Errorf("profile %q sets unknown option %q", name, k)
+		}
+		if err := fs.Set(k, fmt.Sprint(p[k])); err != nil {
+			return fmt.Errorf("profile %q: invalid value for %q: %v", name, k, err)
+		}
+	}
+	activeProfile = name
+	log.Printf("Using profile %q", name)
+	return nil
+}
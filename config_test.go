@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testConfig = `
+default_profile: ci
+profiles:
+  ci:
+    ssh: false
+    vault_token: /profile/vault-token
+    out: /profile/request.bin
+    ssh_out: /profile/ssh-cert
+`
+
+// withConfig writes config to a temporary file used as -config and restores
+// every global flag and the explicit flags when the returned function is
+// called.
+func withConfig(t *testing.T, config string) func() {
+	td, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := filepath.Join(td, "config.yaml")
+	if err := ioutil.WriteFile(fp, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	oldExplicit, oldProfile, oldOut := explicitFlags, activeProfile, *offlineOut
+	explicitFlags = map[string]bool{}
+	*configPath = fp
+	return func() {
+		// Not flag.Set, which would make them look given on the command line.
+		for k, v := range values {
+			flag.Lookup(k).Value.Set(v)
+		}
+		explicitFlags, activeProfile, *offlineOut = oldExplicit, oldProfile, oldOut
+		os.RemoveAll(td)
+	}
+}
+
+// parseCommand parses args like runCommand does and applies the profile.
+func parseCommand(t *testing.T, name string, args ...string) error {
+	others := commandFlags()
+	fs := commandFlagSet(findCommand(name))
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+	return applyConfig(fs, others)
+}
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	defer withConfig(t, testConfig)()
+	if err := parseCommand(t, "request", "-vault_token=/cli/vault-token"); err != nil {
+		t.Fatal(err)
+	}
+	if *vaultTokenPath != "/cli/vault-token" {
+		t.Errorf("vault_token = %q, want the command line over the profile", *vaultTokenPath)
+	}
+	if *requestSSH {
+		t.Error("ssh = true, want false from the profile")
+	}
+	if *offlineOut != "/profile/request.bin" {
+		t.Errorf("out = %q, want the command option from the profile", *offlineOut)
+	}
+	if *rsaKeySize != 4096 {
+		t.Errorf("rsa_key_size = %d, want the default", *rsaKeySize)
+	}
+	if activeProfile != "ci" {
+		t.Errorf("active profile = %q, want the default profile", activeProfile)
+	}
+}
+
+func TestApplyConfigWantedCredentials(t *testing.T) {
+	defer withConfig(t, testConfig)()
+	if err := parseCommand(t, "login", "-kubernetes=false"); err != nil {
+		t.Fatal(err)
+	}
+	if w := wantedCredentials(); w.SSH || !w.Vault {
+		t.Errorf("wanted credentials = %+v, want no SSH certificate but a Vault token", w)
+	}
+}
+
+func TestApplyConfigUnknownOption(t *testing.T) {
+	defer withConfig(t, "profiles:\n  p:\n    no_such_option: 1\n")()
+	*profileName = "p"
+	if err := parseCommand(t, "login"); err == nil {
+		t.Error("a profile with an unknown option was accepted")
+	}
+}
+
+func TestApplyConfigSystemConfig(t *testing.T) {
+	defer withConfig(t, "default_profile: site\nprofiles:\n  site:\n    kube_server: https://kube.test:6443\n")()
+	oldSystem, oldEnv := systemConfig, map[string]string{}
+	for _, k := range []string{"PRODACCESS_CONFIG", "HOME", "XDG_CONFIG_HOME", "AppData"} {
+		oldEnv[k] = os.Getenv(k)
+	}
+	defer func() {
+		systemConfig = oldSystem
+		for k, v := range oldEnv {
+			os.Setenv(k, v)
+		}
+	}()
+	// Without a user configuration the system one is read.
+	td := filepath.Dir(*configPath)
+	systemConfig, *configPath = *configPath, ""
+	os.Unsetenv("PRODACCESS_CONFIG")
+	for _, k := range []string{"HOME", "XDG_CONFIG_HOME", "AppData"} {
+		os.Setenv(k, filepath.Join(td, "home"))
+	}
+
+	if err := parseCommand(t, "login"); err != nil {
+		t.Fatal(err)
+	}
+	if *kubeServer != "https://kube.test:6443" {
+		t.Errorf("kube_server = %q, want it from the system configuration", *kubeServer)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+const (
+	// Clock skew beyond this makes freshly issued certificates look not yet
+	// valid, or already expired, to the servers.
+	maxClockSkew = time.Minute
+)
+
+// check is a prerequisite tested by "prodaccess doctor".
+type check struct {
+	name string
+	run  func() checkResult
+}
+
+type checkResult struct {
+	ok bool
+	// Warnings are failures that only limit what prodaccess can do.
+	warning bool
+	detail  string
+	fix     string
+}
+
+func passed(detail string) checkResult {
+	return checkResult{ok: true, detail: detail}
+}
+
+func failed(detail string, fix string) checkResult {
+	return checkResult{detail: detail, fix: fix}
+}
+
+func warned(detail string, fix string) checkResult {
+	return checkResult{warning: true, detail: detail, fix: fix}
+}
+
+func doctorChecks() []check {
+	cs := []check{
+		{"SSH key", checkSSHKey},
+		{"SSH agent", checkSSHAgent},
+		{"Ident port", checkIdentPort},
+		{"Auth server", checkAuthServer},
+		{"Clock", checkClock},
+		{"kubectl", checkKubectl},
+	}
+	return append(cs, platformChecks()...)
+}
+
+// doctor runs every check and prints the results to w, or as JSON with
+// -output=json. It fails if any check failed.
+func doctor(w io.Writer) error {
+	type result struct {
+		Check  string `json:"check"`
+		State  string `json:"state"`
+		Detail string `json:"detail"`
+		Fix    string `json:"fix,omitempty"`
+	}
+	results := []result{}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	failures := 0
+	for _, c := range doctorChecks() {
+		r := c.run()
+		if r.state() == "FAIL" {
+			failures++
+		}
+		if r.ok {
+			r.fix = ""
+		}
+		results = append(results, result{c.name, r.state(), r.detail, r.fix})
+		if jsonOutput() {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.state(), c.name, r.detail)
+		if r.fix != "" {
+			fmt.Fprintf(tw, "\t\tfix: %s\n", r.fix)
+		}
+	}
+	tw.Flush()
+	if jsonOutput() {
+		if err := writeJSON(results); err != nil {
+			return err
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d checks failed", failures)
+	}
+	return nil
+}
+
+func (r checkResult) state() string {
+	switch {
+	case r.ok:
+		return "ok"
+	case r.warning:
+		return "warn"
+	}
+	return "FAIL"
+}
+
+func checkSSHKey() checkResult {
+	if a, err := openAgent(); err == nil {
+		defer a.Close()
+		caps := a.Capabilities()
+		if caps.CertificateOnly {
+			keys, err := a.List()
+			if err != nil {
+				return failed(fmt.Sprintf("could not list SSH agent keys: %v", err), "restart the SSH agent")
+			}
+			for _, key := range keys {
+				if !strings.HasSuffix(key.Type(), "-cert-v01@openssh.com") && caps.Supports(key.Type()) {
+					return passed(fmt.Sprintf("%s %s in the SSH agent", key.Type(), key.Comment))
+				}
+			}
+			return failed("no key in the SSH agent that it can load a certificate for",
+				fmt.Sprintf("load a key of type %s into the agent", strings.Join(caps.KeyTypes, " or ")))
+		}
+	}
+
+	create := fmt.Sprintf("create one with: ssh-keygen -t ecdsa -b 521 -f %s", sshPrivateKeyPath())
+	pp := sshPublicKeyPath()
+	b, err := ioutil.ReadFile(pp)
+	if err != nil {
+		return failed(fmt.Sprintf("could not read %s: %v", pp, err), create)
+	}
+	k, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return failed(fmt.Sprintf("could not parse %s: %v", pp, err), create)
+	}
+	if _, err := ioutil.ReadFile(sshPrivateKeyPath()); err != nil {
+		return failed(fmt.Sprintf("no private key for %s: %v", pp, err), create)
+	}
+	return passed(fmt.Sprintf("%s %s", k.Type(), pp))
+}
+
+func checkSSHAgent() checkResult {
+	a, err := openAgent()
+	if err != nil {
+		if sshAgentRequired {
+			return failed(fmt.Sprintf("no SSH agent: %v", err), sshAgentFix)
+		}
+		return warned(fmt.Sprintf("no SSH agent, the certificate is only written to a file: %v", err), sshAgentFix)
+	}
+	defer a.Close()
+	keys, err := a.List()
+	if err != nil {
+		return failed(fmt.Sprintf("could not list SSH agent keys: %v", err), "restart the SSH agent")
+	}
+	d := fmt.Sprintf("%d keys loaded", len(keys))
+	if a.Capabilities().CertificateOnly {
+		d += ", certificates only"
+	}
+	return passed(d)
+}
+
+// checkIdentPort checks that the ident server can listen. Another
+// prodaccess is fine, it is told to quit on login.
+func checkIdentPort() checkResult {
+	l, err := net.Listen("tcp", ":1215")
+	if err == nil {
+		l.Close()
+		return passed("port 1215 is free")
+	}
+	c := &http.Client{Timeout: 5 * time.Second}
+	if r, err := c.Get("http://localhost:1215/"); err == nil {
+		r.Body.Close()
+		if r.Header.Get("Access-Control-Allow-Origin") != "" {
+			return passed("port 1215 is used by another prodaccess, which login replaces")
+		}
+	}
+	return failed(fmt.Sprintf("port 1215 is in use: %v", err),
+		"stop the program listening on port 1215, the auth server expects prodaccess there")
+}
+
+func checkAuthServer() checkResult {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := dial(ctx, grpc.WithBlock(), grpc.WithReturnConnectionError())
+	if err != nil {
+		return failed(fmt.Sprintf("could not connect to %s: %v", *grpcService, err),
+			"check the network connection, and -grpc and -server_name if you changed them")
+	}
+	conn.Close()
+	return passed(*grpcService)
+}
+
+// checkClock compares the local clock with the web server's.
+func checkClock() checkResult {
+	c := &http.Client{Timeout: 10 * time.Second}
+	r, err := c.Head(*webUrl)
+	if err != nil {
+		return warned(fmt.Sprintf("could not compare with %s: %v", *webUrl, err), "")
+	}
+	r.Body.Close()
+	t, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return warned(fmt.Sprintf("%s did not tell the time", *webUrl), "")
+	}
+	skew := time.Since(t).Round(time.Second)
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return failed(fmt.Sprintf("local clock is %v off from %s", skew, *webUrl), "synchronize the clock with NTP")
+	}
+	return passed(fmt.Sprintf("%v off from %s", skew, *webUrl))
+}
+
+func checkKubectl() checkResult {
+	p, err := exec.LookPath("kubectl")
+	if err != nil {
+		return warned("kubectl not found in PATH", "install kubectl to use the Kubernetes credentials")
+	}
+	return passed(p)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	pb "github.com/dhtech/proto/auth"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	dryRun = flag.Bool("dry_run", false, "Only show what login and renew would request and change, without contacting the server or changing anything. Other commands that change anything refuse to run")
+)
+
+// plannedChange is something installing a credential would change.
+type plannedChange struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	Action string `json:"action"`
+}
+
+type dryRunPlan struct {
+	// The request that would be sent, with the keys redacted.
+	Request map[string]string `json:"request"`
+	Changes []plannedChange   `json:"changes"`
+	// Not requested because the installed ones are still valid.
+	Valid []string `json:"valid,omitempty"`
+}
+
+// planLogin shows what a login of the credentials in want would do. valid
+// are the credentials that would be skipped.
+func planLogin(w io.Writer, want credentialSet, valid credentialSet) error {
+	p := &dryRunPlan{Request: map[string]string{}, Changes: []plannedChange{}}
+	for _, k := range credentialKinds {
+		if valid.has(k) {
+			p.Valid = append(p.Valid, k)
+		}
+	}
+	if want.any() {
+		ucr, _, err := newCredentialRequest(want)
+		if err != nil {
+			return err
+		}
+		for _, k := range credentialKinds {
+			if !requested(ucr, k) {
+				continue
+			}
+			p.Request[k] = redactedRequest(ucr, k)
+			p.Changes = append(p.Changes, plannedChanges(ucr, k)...)
+		}
+		p.Changes = append(p.Changes, plannedChange{"gc", "expired credentials", "remove, like prodaccess gc"})
+	}
+
+	if jsonOutput() {
+		return writeJSON(p)
+	}
+	p.print(w)
+	return nil
+}
+
+func (p *dryRunPlan) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Would request:")
+	for _, k := range credentialKinds {
+		if r, ok := p.Request[k]; ok {
+			fmt.Fprintf(tw, "  %s\t%s\n", k, r)
+		}
+	}
+	fmt.Fprintln(tw, "Would change:")
+	for _, c := range p.Changes {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", c.Kind, c.Target, c.Action)
+	}
+	for _, k := range p.Valid {
+		fmt.Fprintf(tw, "  %s\t\tnothing, still valid\n", k)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "Dry run, nothing was requested or changed.")
+}
+
+// redactedRequest describes the request for a kind of credential without
+// the keys in it.
+func redactedRequest(ucr *pb.UserCredentialRequest, kind string) string {
+	csr := ""
+	switch kind {
+	case "ssh":
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ucr.SshCertificateRequest.PublicKey))
+		if err != nil {
+			return "SSH certificate for an unparsable public key"
+		}
+		return fmt.Sprintf("SSH certificate for %s %s", k.Type(), ssh.FingerprintSHA256(k))
+	case "vault":
+		return "Vault token"
+	case "kubernetes":
+		return "Kubernetes client certificate"
+	case "vmware":
+		csr = ucr.VmwareCertificateRequest.Csr
+	case "browser":
+		csr = ucr.BrowserCertificateRequest.Csr
+	}
+	if blk, _ := pem.Decode([]byte(csr)); blk != nil {
+		if cr, err := x509.ParseCertificateRequest(blk.Bytes); err == nil {
+			return fmt.Sprintf("certificate for a new %s key", cr.PublicKeyAlgorithm)
+		}
+	}
+	return "certificate for a new key"
+}
+
+// plannedChanges returns what installing a kind of credential would change.
+func plannedChanges(ucr *pb.UserCredentialRequest, kind string) []plannedChange {
+	cs := []plannedChange{}
+	add := func(target string, action string) {
+		cs = append(cs, plannedChange{kind, target, action})
+	}
+	switch kind {
+	case "ssh":
+		if a, err := openAgent(); err == nil {
+			if k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ucr.SshCertificateRequest.PublicKey)); err == nil {
+				add("SSH agent", "add certificate identity for "+ssh.FingerprintSHA256(k))
+			}
+			a.Close()
+		} else {
+			log.Printf("no SSH agent to load the certificate into: %v", err)
+		}
+	case "vault":
+		add(os.ExpandEnv(*vaultTokenPath), "replace token")
+	case "kubernetes":
+		if *kubeExec {
+			add(os.ExpandEnv(*kubeCredentialCache), "write certificate and key")
+			add(kubeconfigFile("user", *kubeUser), fmt.Sprintf("set user %q to run kube-credential", *kubeUser))
+		} else {
+			add(kubeconfigFile("user", *kubeUser), fmt.Sprintf("set user %q", *kubeUser))
+		}
+		if *kubeServer != "" {
+			add(kubeconfigFile("cluster", *kubeCluster), fmt.Sprintf("set cluster %q to %s", *kubeCluster, *kubeServer))
+			add(kubeconfigFile("context", *kubeContext), fmt.Sprintf("set context %q", *kubeContext))
+		}
+	}
+	return append(cs, platformChanges(kind)...)
+}
+
+// kubeconfigFile returns the file an entry would be written to: the first
+// one in $KUBECONFIG that has it, or the default file for new entries.
+func kubeconfigFile(kind string, name string) string {
+	po := clientcmd.NewDefaultPathOptions()
+	for _, fp := range po.GetLoadingPrecedence() {
+		cfg, err := clientcmd.LoadFromFile(fp)
+		if err != nil {
+			continue
+		}
+		found := false
+		switch kind {
+		case "user":
+			_, found = cfg.AuthInfos[name]
+		case "cluster":
+			_, found = cfg.Clusters[name]
+		case "context":
+			_, found = cfg.Contexts[name]
+		}
+		if found {
+			return fp
+		}
+	}
+	return po.GetDefaultFilename()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	envShell  = flag.String("shell", "", "Shell syntax to print the environment in: bash, zsh, fish or powershell, detected if empty")
+	exportEnv = flag.Bool("export_env", false, "After login, print the environment like \"prodaccess env\" does")
+)
+
+// envVar is an environment variable telling where a credential is.
+type envVar struct {
+	Name  string
+	Value string
+}
+
+// environment returns the variables pointing programs at the credentials
+// of the active profile.
+func environment() []envVar {
+	vs := []envVar{}
+	if activeProfile != "" {
+		vs = append(vs, envVar{"PRODACCESS_PROFILE", activeProfile})
+	}
+	if t, err := ioutil.ReadFile(os.ExpandEnv(*vaultTokenPath)); err == nil {
+		vs = append(vs, envVar{"VAULT_TOKEN", strings.TrimSpace(string(t))})
+	}
+	kc := clientcmd.NewDefaultPathOptions().GetLoadingPrecedence()
+	vs = append(vs, envVar{"KUBECONFIG", strings.Join(kc, string(filepath.ListSeparator))})
+	return append(vs, platformEnv()...)
+}
+
+func detectShell() string {
+	if *envShell != "" {
+		return *envShell
+	}
+	if runtime.GOOS == "windows" {
+		return "powershell"
+	}
+	if filepath.Base(os.Getenv("SHELL")) == "fish" {
+		return "fish"
+	}
+	return "bash"
+}
+
+// printEnv prints vs as statements that set them in the given shell.
+func printEnv(w io.Writer, shell string, vs []envVar) error {
+	var f func(envVar) string
+	switch shell {
+	case "bash", "zsh", "sh":
+		f = func(v envVar) string {
+			return fmt.Sprintf("export %s='%s'", v.Name, strings.Replace(v.Value, "'", `'\''`, -1))
+		}
+	case "fish":
+		r := strings.NewReplacer(`\`, `\\`, "'", `\'`)
+		f = func(v envVar) string {
+			return fmt.Sprintf("set -gx %s '%s'", v.Name, r.Replace(v.Value))
+		}
+	case "powershell", "pwsh":
+		f = func(v envVar) string {
+			return fmt.Sprintf("$env:%s = '%s'", v.Name, strings.Replace(v.Value, "'", "''", -1))
+		}
+	default:
+		return fmt.Errorf("unsupported shell %q, use bash, zsh, fish or powershell", shell)
+	}
+	for _, v := range vs {
+		fmt.Fprintln(w, f(v))
+	}
+	return nil
+}
+
+// envMap returns vs for the JSON document.
+func envMap(vs []envVar) map[string]string {
+	m := map[string]string{}
+	for _, v := range vs {
+		m[v.Name] = v.Value
+	}
+	return m
+}
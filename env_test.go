@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+)
+
+var envTestValues = []string{
+	"plain",
+	"with space",
+	"it's",
+	`$HOME and $(id) and ${X}`,
+	`back\slash`,
+	`"double" 'single'`,
+}
+
+func TestPrintEnv(t *testing.T) {
+	for _, c := range []struct {
+		shell string
+		value string
+		want  string
+	}{
+		{"bash", "with space", "export X='with space'\n"},
+		{"bash", "it's", `export X='it'\''s'` + "\n"},
+		{"bash", "$HOME", "export X='$HOME'\n"},
+		{"zsh", "it's", `export X='it'\''s'` + "\n"},
+		{"fish", "it's", `set -gx X 'it\'s'` + "\n"},
+		{"fish", `a\b`, `set -gx X 'a\\b'` + "\n"},
+		{"fish", "$HOME x", "set -gx X '$HOME x'\n"},
+		{"powershell", "it's", "$env:X = 'it''s'\n"},
+		{"powershell", "$HOME x", "$env:X = '$HOME x'\n"},
+		{"pwsh", `a\b`, `$env:X = 'a\b'` + "\n"},
+	} {
+		var b bytes.Buffer
+		if err := printEnv(&b, c.shell, []envVar{{"X", c.value}}); err != nil {
+			t.Fatalf("%s: %v", c.shell, err)
+		}
+		if b.String() != c.want {
+			t.Errorf("%s %q: got %q, want %q", c.shell, c.value, b.String(), c.want)
+		}
+	}
+
+	if err := printEnv(&bytes.Buffer{}, "tcsh", nil); err == nil {
+		t.Error("printEnv accepted an unsupported shell")
+	}
+}
+
+// TestPrintEnvRoundTrip evaluates the output in the shells that are
+// installed and checks that they get the values back unchanged.
+func TestPrintEnvRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		shell string
+		args  []string
+		print string
+	}{
+		{"bash", []string{"-c"}, `printf %s "$X"`},
+		{"fish", []string{"-c"}, `printf %s "$X"`},
+		{"pwsh", []string{"-NoProfile", "-Command"}, `[Console]::Out.Write($env:X)`},
+	} {
+		if _, err := exec.LookPath(c.shell); err != nil {
+			continue
+		}
+		for _, v := range envTestValues {
+			var b bytes.Buffer
+			if err := printEnv(&b, c.shell, []envVar{{"X", v}}); err != nil {
+				t.Fatal(err)
+			}
+			out, err := exec.Command(c.shell, append(c.args, b.String()+"\n"+c.print)...).Output()
+			if err != nil {
+				t.Errorf("%s: %v", c.shell, err)
+				continue
+			}
+			if string(out) != v {
+				t.Errorf("%s: %q came back as %q", c.shell, v, out)
+			}
+		}
+	}
+}
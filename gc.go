@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhtech/prodaccess/sshagent"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// removePolicy decides from its expiry whether an installed credential is
+// removed.
+type removePolicy func(exp time.Time) bool
+
+func expired(exp time.Time) bool {
+	return exp.Before(time.Now())
+}
+
+func always(exp time.Time) bool {
+	return true
+}
+
+// garbageCollect removes expired prodaccess issued credentials from every
+// place prodaccess installs them. It is run after every login and by
+// "prodaccess gc".
+func garbageCollect() {
+	removeCredentials(expired)
+}
+
+// logout removes all prodaccess issued credentials.
+func logout() {
+	removeCredentials(always)
+
+	tp := os.ExpandEnv(*vaultTokenPath)
+	if err := os.Remove(tp); err == nil {
+		removed(tp, time.Time{})
+	} else if !os.IsNotExist(err) {
+		log.Printf("could not remove %s: %v", tp, err)
+	}
+}
+
+// removedCredential is a credential removed by logout or gc.
+type removedCredential struct {
+	Location string     `json:"location"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+}
+
+var (
+	removalsMu sync.Mutex
+	// removals are the credentials removed by this run, for -output=json.
+	removals = []removedCredential{}
+)
+
+// removed logs and records that the credential at location was removed. exp
+// is zero if its expiry is not known.
+func removed(location string, exp time.Time) {
+	r := removedCredential{Location: location}
+	if exp.IsZero() {
+		log.Printf("removed %s", location)
+	} else {
+		log.Printf("removed %s, valid until %v", location, exp)
+		r.NotAfter = &exp
+	}
+	removalsMu.Lock()
+	removals = append(removals, r)
+	removalsMu.Unlock()
+}
+
+// printRemovals prints what was removed with -output=json.
+func printRemovals() error {
+	if !jsonOutput() {
+		return nil
+	}
+	removalsMu.Lock()
+	defer removalsMu.Unlock()
+	return writeJSON(struct {
+		Removed []removedCredential `json:"removed"`
+	}{removals})
+}
+
+func removeCredentials(remove removePolicy) {
+	removeKubernetes(remove)
+	removePlatform(remove)
+}
+
+// removeFile removes the credential file at fp, expiry tells when it
+// expires.
+func removeFile(fp string, expiry func(string) (time.Time, error), remove removePolicy) {
+	exp, err := expiry(fp)
+	if err != nil || !remove(exp) {
+		return
+	}
+	if err := os.Remove(fp); err != nil {
+		log.Printf("could not remove %s: %v", fp, err)
+		return
+	}
+	removed(fp, exp)
+}
+
+// sshOwnKey returns the key prodaccess requests SSH certificates for, or nil
+// if it is not known without asking the agent.
+func sshOwnKey() ssh.PublicKey {
+	b, err := ioutil.ReadFile(sshPublicKeyPath())
+	if err != nil {
+		return nil
+	}
+	k, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil
+	}
+	return k
+}
+
+// removeAgentCertificates removes certificates for our key from an SSH agent.
+func removeAgentCertificates(a sshagent.Agent, remove removePolicy) {
+	keys, err := a.List()
+	if err != nil {
+		log.Printf("could not list SSH agent keys: %v", err)
+		return
+	}
+	// Without our key, certificates from other CAs cannot be told apart.
+	own := sshOwnKey()
+	if own == nil {
+		log.Printf("not removing SSH certificates from the agent, could not read %s", sshPublicKeyPath())
+		return
+	}
+	for _, key := range keys {
+		if !strings.HasSuffix(key.Type(), "-cert-v01@openssh.com") {
+			continue
+		}
+		pk, err := ssh.ParsePublicKey(key.Blob)
+		if err != nil {
+			continue
+		}
+		cert := pk.(*ssh.Certificate)
+		if !bytes.Equal(cert.Key.Marshal(), own.Marshal()) {
+			continue
+		}
+		exp := time.Unix(int64(cert.ValidBefore), 0)
+		if cert.ValidBefore == ssh.CertTimeInfinity || !remove(exp) {
+			continue
+		}
+		if err := a.Remove(pk); err != nil {
+			log.Printf("could not remove SSH certificate %q from agent: %v", key.Comment, err)
+			continue
+		}
+		removed(fmt.Sprintf("SSH certificate %q in the SSH agent", key.Comment), exp)
+	}
+}
+
+func removeKubernetes(remove removePolicy) {
+	cp := os.ExpandEnv(*kubeCredentialCache)
+	if _, _, exp, err := loadKubeCredentialCache(); err == nil && remove(exp) {
+		if err := os.Remove(cp); err != nil {
+			log.Printf("could not remove %s: %v", cp, err)
+		} else {
+			removed(cp, exp)
+		}
+	}
+
+	po := clientcmd.NewDefaultPathOptions()
+	cfg, err := po.GetStartingConfig()
+	if err != nil {
+		return
+	}
+	ai, ok := cfg.AuthInfos[*kubeUser]
+	if !ok || len(ai.ClientCertificateData) == 0 {
+		return
+	}
+	exp, err := pemCertExpiry(ai.ClientCertificateData)
+	if err != nil || !remove(exp) {
+		return
+	}
+	ai.ClientCertificateData = nil
+	ai.ClientKeyData = nil
+	if err := clientcmd.ModifyConfig(po, *cfg, true); err != nil {
+		log.Printf("could not update kubeconfig: %v", err)
+		return
+	}
+	removed(fmt.Sprintf("certificate of kubeconfig user %q", *kubeUser), exp)
+}
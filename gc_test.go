@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dhtech/prodaccess/sshagent"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRemoveAgentCertificates(t *testing.T) {
+	f := sshagent.NewFake(sshagent.Capabilities{CertificateOnly: true})
+	defer withAgent(t, f)()
+	own := testECDSAKey(t)
+	writeSSHKey(t, own)
+
+	valid := uint64(time.Now().Add(time.Hour).Unix())
+	ours, c := testSSHCertificate(t, own, valid)
+	other, oc := testSSHCertificate(t, testECDSAKey(t), valid)
+	for _, s := range []string{c, oc} {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.AddCertificate(pk.(*ssh.Certificate), nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeAgentCertificates(f, expired)
+	if !hasAgentCertificate(t, f, ours) {
+		t.Error("gc removed a valid certificate")
+	}
+	removeAgentCertificates(f, always)
+	if hasAgentCertificate(t, f, ours) {
+		t.Error("logout left the certificate for our key")
+	}
+	if !hasAgentCertificate(t, f, other) {
+		t.Error("logout removed a certificate for another key")
+	}
+}
+
+func TestRemoveAgentCertificatesWithoutOwnKey(t *testing.T) {
+	f := sshagent.NewFake(sshagent.Capabilities{CertificateOnly: true})
+	defer withAgent(t, f)()
+	cert, _ := testSSHCertificate(t, testECDSAKey(t), uint64(time.Now().Add(time.Hour).Unix()))
+	if err := f.AddCertificate(cert, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	removeAgentCertificates(f, always)
+	if !hasAgentCertificate(t, f, cert) {
+		t.Error("logout without a public key removed a certificate from the agent")
+	}
+}
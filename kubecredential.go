@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	pb "github.com/dhtech/proto/auth"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientauthv1 "k8s.io/client-go/pkg/apis/clientauthentication/v1"
+)
+
+var (
+	kubeCredentialCache = flag.String("kube_credential_cache", defaultKubeCredentialCache(), "Where to cache the Kubernetes client certificate for kube-credential")
+	kubeRenewBefore     = flag.Duration("kube_renew_before", 10*time.Minute, "Renew the cached Kubernetes certificate when it expires within this duration")
+)
+
+func defaultKubeCredentialCache() string {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "prodaccess-kube-credential.pem"
+	}
+	return filepath.Join(d, "prodaccess", "kube-credential.pem")
+}
+
+// saveKubeCredentialCache stores the certificate and key as one PEM file so
+// that kube-credential can serve it without talking to the auth server.
+func saveKubeCredentialCache(c string, k string) error {
+	cp := os.ExpandEnv(*kubeCredentialCache)
+	if err := os.MkdirAll(filepath.Dir(cp), 0700); err != nil {
+		return err
+	}
+	os.Remove(cp)
+	return ioutil.WriteFile(cp, []byte(c+"\n"+k), 0600)
+}
+
+// loadKubeCredentialCache returns the cached certificate chain and key in PEM
+// together with the expiry of the leaf certificate.
+func loadKubeCredentialCache() (string, string, time.Time, error) {
+	b, err := ioutil.ReadFile(os.ExpandEnv(*kubeCredentialCache))
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	var certs, key []byte
+	var leaf *x509.Certificate
+	for {
+		var blk *pem.Block
+		blk, b = pem.Decode(b)
+		if blk == nil {
+			break
+		}
+		if blk.Type != "CERTIFICATE" {
+			key = append(key, pem.EncodeToMemory(blk)...)
+			continue
+		}
+		if leaf == nil {
+			leaf, err = x509.ParseCertificate(blk.Bytes)
+			if err != nil {
+				return "", "", time.Time{}, fmt.Errorf("could not parse cached certificate: %v", err)
+			}
+		}
+		certs = append(certs, pem.EncodeToMemory(blk)...)
+	}
+	if leaf == nil || len(key) == 0 {
+		return "", "", time.Time{}, fmt.Errorf("incomplete credential cache")
+	}
+	return string(certs), string(key), leaf.NotAfter, nil
+}
+
+// kubeCredential implements the client-go exec credential plugin protocol.
+// The cached certificate is served as long as it is valid for longer than
+// -kube_renew_before, otherwise a new one is requested first. Only the
+// ExecCredential is printed on stdout, logging goes to stderr.
+func kubeCredential() error {
+	c, k, exp, err := loadKubeCredentialCache()
+	if err != nil {
+		log.Printf("no usable cached Kubernetes credential: %v", err)
+	}
+	if err != nil || time.Until(exp) < *kubeRenewBefore {
+		c, k, exp, err = renewKubeCredential()
+		if err != nil {
+			return err
+		}
+	}
+
+	ec := &clientauthv1.ExecCredential{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "client.authentication.k8s.io/v1",
+			Kind:       "ExecCredential",
+		},
+		Status: &clientauthv1.ExecCredentialStatus{
+			ExpirationTimestamp:   &metav1.Time{Time: exp},
+			ClientCertificateData: c,
+			ClientKeyData:         k,
+		},
+	}
+	return json.NewEncoder(os.Stdout).Encode(ec)
+}
+
+func renewKubeCredential() (string, string, time.Time, error) {
+	log.Printf("Renewing Kubernetes credential")
+	response, err := requestCredentials(&pb.UserCredentialRequest{
+		KubernetesCertificateRequest: &pb.KubernetesCertificateRequest{},
+	}, nil)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	if response.KubernetesCertificate == nil {
+		return "", "", time.Time{}, fmt.Errorf("no Kubernetes certificate was issued")
+	}
+	kc := response.KubernetesCertificate
+	if err := saveKubeCredentialCache(kc.Certificate, kc.PrivateKey); err != nil {
+		return "", "", time.Time{}, fmt.Errorf("could not write Kubernetes credential cache: %v", err)
+	}
+	return loadKubeCredentialCache()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+var (
+	kubeUser    = flag.String("kube_user", "dhtech", "Name of the kubeconfig user entry to write")
+	kubeCluster = flag.String("kube_cluster", "dhtech", "Name of the kubeconfig cluster entry to write")
+	kubeContext = flag.String("kube_context", "dhtech", "Name of the kubeconfig context entry to write")
+	kubeServer  = flag.String("kube_server", "", "Kubernetes API server URL, cluster and context are only written if set")
+	kubeCA      = flag.String("kube_ca", "", "CA bundle of the Kubernetes API server, as a path or PEM, system roots are used if empty")
+	kubeRequest = newAutoBool("kubernetes", "Whether or not to request a Kubernetes certificate, or auto to detect a Kubernetes setup")
+	kubeExec    = flag.Bool("kube_exec", false, "Make kubeconfig fetch credentials with 'prodaccess kube-credential' instead of embedding them")
+)
+
+// wantKubernetesCertificate decides whether to request a Kubernetes
+// certificate. Unless told explicitly, one is requested if a server is
+// configured or there is any sign of the user talking to Kubernetes: an
+// existing kubeconfig or kubectl on the PATH.
+func wantKubernetesCertificate() bool {
+	if v, ok := kubeRequest.Get(); ok {
+		return v
+	}
+
+	if *kubeServer != "" {
+		return true
+	}
+	for _, p := range clientcmd.NewDefaultPathOptions().GetLoadingPrecedence() {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	_, err := exec.LookPath("kubectl")
+	return err == nil
+}
+
+// saveKubernetesCertificate installs the certificate in the kubeconfig. Only
+// with -kube_exec is it cached for kube-credential too, otherwise the
+// kubeconfig embeds it and nothing reads the cache.
+func saveKubernetesCertificate(c string, k string) error {
+	errs := errorList{}
+	if *kubeExec {
+		if err := saveKubeCredentialCache(c, k); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write Kubernetes credential cache: %v", err))
+		}
+	}
+	if err := writeKubeconfig([]byte(c), []byte(k)); err != nil {
+		errs = append(errs, fmt.Errorf("failed to update kubeconfig: %v", err))
+	}
+	return errs.asError()
+}
+
+// writeKubeconfig updates the user, cluster and context entries in the
+// kubeconfig. Like kubectl, $KUBECONFIG may list several files and every
+// entry is written back to the file it was loaded from.
+func writeKubeconfig(cert []byte, key []byte) error {
+	po := clientcmd.NewDefaultPathOptions()
+	cfg, err := po.GetStartingConfig()
+	if err != nil {
+		return fmt.Errorf("could not load kubeconfig: %v", err)
+	}
+
+	ai, ok := cfg.AuthInfos[*kubeUser]
+	if !ok {
+		ai = clientcmdapi.NewAuthInfo()
+		cfg.AuthInfos[*kubeUser] = ai
+	}
+	ai.ClientCertificate = ""
+	ai.ClientKey = ""
+	if *kubeExec {
+		e, err := kubeExecConfig()
+		if err != nil {
+			return err
+		}
+		ai.Exec = e
+		ai.ClientCertificateData = nil
+		ai.ClientKeyData = nil
+	} else {
+		ai.Exec = nil
+		ai.ClientCertificateData = cert
+		ai.ClientKeyData = key
+	}
+
+	if *kubeServer == "" {
+		log.Printf("no Kubernetes server configured, only updating kubeconfig user %q. Set kube_server and kube_ca in the configuration to also write the cluster and context", *kubeUser)
+		return clientcmd.ModifyConfig(po, *cfg, true)
+	}
+
+	cl, ok := cfg.Clusters[*kubeCluster]
+	if !ok {
+		cl = clientcmdapi.NewCluster()
+		cfg.Clusters[*kubeCluster] = cl
+	}
+	cl.Server = *kubeServer
+	if *kubeCA != "" {
+		ca := []byte(*kubeCA)
+		if !strings.HasPrefix(strings.TrimSpace(*kubeCA), "-----BEGIN") {
+			if ca, err = ioutil.ReadFile(os.ExpandEnv(*kubeCA)); err != nil {
+				return fmt.Errorf("could not read Kubernetes CA: %v", err)
+			}
+		}
+		cl.CertificateAuthority = ""
+		cl.CertificateAuthorityData = ca
+	}
+
+	kc, ok := cfg.Contexts[*kubeContext]
+	if !ok {
+		kc = clientcmdapi.NewContext()
+		cfg.Contexts[*kubeContext] = kc
+	}
+	kc.Cluster = *kubeCluster
+	kc.AuthInfo = *kubeUser
+
+	if cfg.CurrentContext == "" {
+		cfg.CurrentContext = *kubeContext
+	}
+	return clientcmd.ModifyConfig(po, *cfg, true)
+}
+
+// kubeCredentialFlags are the flags kube-credential needs, the ones given
+// to login are passed on to it. Others, like -force or -output, would apply
+// to every kubectl call.
+var kubeCredentialFlags = map[string]bool{
+	"grpc":                  true,
+	"server_name":           true,
+	"tls":                   true,
+	"web":                   true,
+	"auth_token_file":       true,
+	"client_cert":           true,
+	"client_key":            true,
+	"request_timeout":       true,
+	"max_actions":           true,
+	"action_types":          true,
+	"kube_credential_cache": true,
+	"kube_renew_before":     true,
+	"config":                true,
+	"profile":               true,
+}
+
+// kubeExecConfig returns the exec plugin stanza that runs this binary in
+// kube-credential mode with the command line flags of the current
+// invocation it needs. Settings from the profile are picked up again by the
+// plugin, the configuration and profile taken from the environment are
+// passed explicitly since kubectl may run with another one.
+func kubeExecConfig() (*clientcmdapi.ExecConfig, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("could not find prodaccess executable: %v", err)
+	}
+	args := []string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if explicitFlags[f.Name] && kubeCredentialFlags[f.Name] {
+			args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+		}
+	})
+	if cp := os.Getenv("PRODACCESS_CONFIG"); cp != "" && !explicitFlags["config"] {
+		args = append(args, "-config="+cp)
+	}
+	if activeProfile != "" && !explicitFlags["profile"] && os.Getenv("PRODACCESS_PROFILE") == activeProfile {
+		args = append(args, "-profile="+activeProfile)
+	}
+	args = append(args, "kube-credential")
+	return &clientcmdapi.ExecConfig{
+		APIVersion:      "client.authentication.k8s.io/v1",
+		Command:         exe,
+		Args:            args,
+		InteractiveMode: clientcmdapi.IfAvailableExecInteractiveMode,
+	}, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// withKubeconfig points $KUBECONFIG and the credential cache at a temporary
+// directory until the returned function is called.
+func withKubeconfig(t *testing.T) (string, func()) {
+	td, err := ioutil.TempDir("", "kube")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc := filepath.Join(td, "config")
+	oldConfig, oldCache, oldExec := os.Getenv("KUBECONFIG"), *kubeCredentialCache, *kubeExec
+	os.Setenv("KUBECONFIG", kc)
+	*kubeCredentialCache = filepath.Join(td, "cache.pem")
+	return kc, func() {
+		os.Setenv("KUBECONFIG", oldConfig)
+		*kubeCredentialCache, *kubeExec = oldCache, oldExec
+		os.RemoveAll(td)
+	}
+}
+
+func TestSaveKubernetesCertificateEmbedded(t *testing.T) {
+	kc, done := withKubeconfig(t)
+	defer done()
+	*kubeExec = false
+
+	if err := saveKubernetesCertificate("cert", "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(*kubeCredentialCache); !os.IsNotExist(err) {
+		t.Errorf("credential cache written without -kube_exec: %v", err)
+	}
+	cfg, err := clientcmd.LoadFromFile(kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ai := cfg.AuthInfos[*kubeUser]
+	if ai == nil || string(ai.ClientCertificateData) != "cert" || ai.Exec != nil {
+		t.Errorf("kubeconfig user = %+v, want the embedded certificate", ai)
+	}
+}
+
+func TestSaveKubernetesCertificateExec(t *testing.T) {
+	kc, done := withKubeconfig(t)
+	defer done()
+	*kubeExec = true
+
+	if err := saveKubernetesCertificate("cert", "key"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(*kubeCredentialCache); err != nil || string(b) != "cert\nkey" {
+		t.Errorf("credential cache = %q, %v", b, err)
+	}
+	cfg, err := clientcmd.LoadFromFile(kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ai := cfg.AuthInfos[*kubeUser]
+	if ai == nil || ai.Exec == nil || len(ai.ClientCertificateData) != 0 {
+		t.Errorf("kubeconfig user = %+v, want the exec plugin", ai)
+	}
+}
+
+func TestSaveKubernetesCertificateInlineCA(t *testing.T) {
+	kc, done := withKubeconfig(t)
+	defer done()
+	oldServer, oldCA := *kubeServer, *kubeCA
+	defer func() { *kubeServer, *kubeCA = oldServer, oldCA }()
+	*kubeExec = false
+	*kubeServer = "https://kube.test:6443"
+	*kubeCA = "-----BEGIN CERTIFICATE-----\nca\n-----END CERTIFICATE-----\n"
+
+	if err := saveKubernetesCertificate("cert", "key"); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := clientcmd.LoadFromFile(kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := cfg.Clusters[*kubeCluster]
+	if cl == nil || cl.Server != *kubeServer || string(cl.CertificateAuthorityData) != *kubeCA {
+		t.Errorf("kubeconfig cluster = %+v, want the server and the inline CA", cl)
+	}
+	if cfg.CurrentContext == "" {
+		t.Error("no current context set")
+	}
+}
+
+func TestKubeExecConfigArgs(t *testing.T) {
+	oldExplicit, oldProfile, oldEnv := explicitFlags, activeProfile, os.Getenv("PRODACCESS_PROFILE")
+	defer func() {
+		explicitFlags, activeProfile = oldExplicit, oldProfile
+		os.Setenv("PRODACCESS_PROFILE", oldEnv)
+	}()
+	explicitFlags = map[string]bool{"force": true, "output": true, "grpc": true}
+	activeProfile = "ci"
+	os.Setenv("PRODACCESS_PROFILE", "ci")
+
+	e, err := kubeExecConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-grpc=" + *grpcService, "-profile=ci", "kube-credential"}
+	if len(e.Args) != len(want) {
+		t.Fatalf("exec args = %q, want %q", e.Args, want)
+	}
+	for i := range want {
+		if e.Args[i] != want[i] {
+			t.Errorf("exec args = %q, want %q", e.Args, want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	url "github.com/dhtech/go-openurl"
+)
+
+var (
+	browserCommand = flag.String("browser_command", "", "Command to open URLs with, %s is replaced by the URL or it is added last, print to only print them. $BROWSER is used if empty, then the system default")
+)
+
+// openBrowser opens u in the configured browser. If that fails, the URL is
+// printed for the user to open.
+func openBrowser(u string) {
+	if err := launchBrowser(u); err != nil {
+		log.Printf("could not open a browser: %v", err)
+		fmt.Fprintf(os.Stderr, "Open this URL in your browser: %s\n", u)
+	}
+}
+
+func launchBrowser(u string) error {
+	c := *browserCommand
+	ts := []string{c}
+	if c == "" {
+		// Like elsewhere, $BROWSER may list several commands to try in order.
+		c = os.Getenv("BROWSER")
+		ts = strings.Split(c, string(os.PathListSeparator))
+	}
+	switch c {
+	case "print":
+		fmt.Fprintf(os.Stderr, "Open this URL in your browser: %s\n", u)
+		return nil
+	case "":
+		return url.Open(u)
+	}
+
+	errs := errorList{}
+	for _, t := range ts {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		err := runBrowser(t, u)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errs.asError()
+}
+
+// browserArgs returns the command line of the template t for u. A template
+// without %s that names a file is the browser itself, so that paths with
+// spaces need no quoting. Otherwise it is split into words like a shell
+// does, with single and double quotes.
+func browserArgs(t string, u string) ([]string, error) {
+	if !strings.Contains(t, "%s") {
+		if fi, err := os.Stat(t); err == nil && !fi.IsDir() {
+			return []string{t, u}, nil
+		}
+	}
+	args, err := splitCommand(t)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty browser command")
+	}
+	found := false
+	for i, a := range args {
+		if strings.Contains(a, "%s") {
+			args[i] = strings.Replace(a, "%s", u, -1)
+			found = true
+		}
+	}
+	if !found {
+		args = append(args, u)
+	}
+	return args, nil
+}
+
+// splitCommand splits s into words at spaces outside quotes. Backslashes
+// only escape quotes and backslashes within double quotes, as they separate
+// Windows paths.
+func splitCommand(s string) ([]string, error) {
+	words := []string{}
+	var w strings.Builder
+	inWord := false
+	var quote rune
+	rs := []rune(s)
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				w.WriteRune(r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' && i+1 < len(rs) && (rs[i+1] == '"' || rs[i+1] == '\\') {
+				i++
+				w.WriteRune(rs[i])
+			} else {
+				w.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, w.String())
+				w.Reset()
+				inWord = false
+			}
+		default:
+			w.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c in browser command %q", quote, s)
+	}
+	if inWord {
+		words = append(words, w.String())
+	}
+	return words, nil
+}
+
+// runBrowser starts the command template t for u without waiting for it, as
+// browsers may keep running.
+func runBrowser(t string, u string) error {
+	args, err := browserArgs(t, u)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not run %s: %v", args[0], err)
+	}
+	go cmd.Wait()
+	return nil
+}
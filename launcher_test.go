@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBrowserArgs(t *testing.T) {
+	const u = "https://auth.example.com/a?b=c"
+	for _, tc := range []struct {
+		template string
+		want     []string
+	}{
+		{"firefox", []string{"firefox", u}},
+		{"firefox -P crew %s", []string{"firefox", "-P", "crew", u}},
+		{"firefox --new-tab=%s", []string{"firefox", "--new-tab=" + u}},
+		{`"/mnt/c/Program Files/Mozilla Firefox/firefox.exe" -P crew %s`, []string{"/mnt/c/Program Files/Mozilla Firefox/firefox.exe", "-P", "crew", u}},
+		{`'/mnt/c/Program Files/Mozilla Firefox/firefox.exe'`, []string{"/mnt/c/Program Files/Mozilla Firefox/firefox.exe", u}},
+		{`C:\Tools\browser.exe -P "my \"crew\"" %s`, []string{`C:\Tools\browser.exe`, "-P", `my "crew"`, u}},
+		{`firefox -P ""`, []string{"firefox", "-P", "", u}},
+	} {
+		got, err := browserArgs(tc.template, u)
+		if err != nil {
+			t.Errorf("browserArgs(%q): %v", tc.template, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("browserArgs(%q) = %q, want %q", tc.template, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"", "  ", `firefox "-P`} {
+		if got, err := browserArgs(bad, u); err == nil {
+			t.Errorf("browserArgs(%q) = %q, want an error", bad, got)
+		}
+	}
+}
+
+func TestBrowserArgsPathWithSpaces(t *testing.T) {
+	td, err := ioutil.TempDir("", "launcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	dir := filepath.Join(td, "Program Files", "Mozilla Firefox")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	exe := filepath.Join(dir, "firefox.exe")
+	if err := ioutil.WriteFile(exe, nil, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := browserArgs(exe, "https://auth.example.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{exe, "https://auth.example.com/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("browserArgs(%q) = %q, want %q", exe, got, want)
+	}
+}
@@ -0,0 +1,127 @@
+// +build freebsd linux darwin
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Nickname of the browser certificate, used to find and replace the
+	// certificate issued by a previous run.
+	browserCertName = "prodaccess-browser"
+)
+
+var (
+	nssDatabases = flag.String("nss_databases", "", "Comma separated NSS database directories to import the browser certificate into, detected if empty")
+)
+
+// findNSSDatabases returns the NSS databases of Chromium and Firefox under
+// the given home directory. Only SQL databases (cert9.db) are supported.
+func findNSSDatabases(home string) []string {
+	patterns := []string{
+		filepath.Join(home, ".pki", "nssdb"),
+		filepath.Join(home, ".mozilla", "firefox", "*"),
+		filepath.Join(home, "snap", "firefox", "common", ".mozilla", "firefox", "*"),
+		filepath.Join(home, "Library", "Application Support", "Firefox", "Profiles", "*"),
+	}
+
+	dbs := []string{}
+	for _, p := range patterns {
+		m, _ := filepath.Glob(filepath.Join(p, "cert9.db"))
+		for _, db := range m {
+			dbs = append(dbs, filepath.Dir(db))
+		}
+	}
+	return dbs
+}
+
+func nssDatabaseList() []string {
+	if *nssDatabases != "" {
+		return strings.Split(*nssDatabases, ",")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	return findNSSDatabases(home)
+}
+
+// hasBrowserProfile returns true if there is a browser the browser
+// certificate can be installed into.
+func hasBrowserProfile() bool {
+	return len(nssDatabaseList()) > 0
+}
+
+// importCertToNSS installs the PFX into every NSS database found.
+func importCertToNSS(pfx string) error {
+	dbs := nssDatabaseList()
+	if len(dbs) == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath("pk12util"); err != nil {
+		return fmt.Errorf("found NSS databases but no pk12util, install the NSS tools")
+	}
+
+	failed := 0
+	for _, db := range dbs {
+		if err := nssImport(db, pfx); err != nil {
+			log.Printf("failed to import browser certificate into %s: %v", db, err)
+			failed++
+			continue
+		}
+		log.Printf("imported browser certificate into %s", db)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d NSS databases were not updated", failed, len(dbs))
+	}
+	return nil
+}
+
+// nssImport replaces any previously imported prodaccess certificate in the
+// NSS database db with the one in pfx.
+func nssImport(db string, pfx string) error {
+	d := "sql:" + db
+	// A database may hold several certificates with the same nickname if
+	// earlier imports were interrupted, so delete until none is left.
+	for i := 0; i < 16; i++ {
+		if !nssHasCert(d, browserCertName) {
+			break
+		}
+		if _, err := executeWithStdout("certutil", "-d", d, "-F", "-n", browserCertName); err != nil {
+			return err
+		}
+	}
+	_, err := executeWithStdout("pk12util", "-d", d, "-i", pfx, "-W", "", "-K", "")
+	return err
+}
+
+func nssHasCert(d string, name string) bool {
+	return exec.Command("/usr/bin/env", "certutil", "-d", d, "-L", "-n", name).Run() == nil
+}
+
+// removeNSS removes the prodaccess browser certificate from the NSS database
+// db.
+func removeNSS(db string, remove removePolicy) {
+	d := "sql:" + db
+	for i := 0; i < 16; i++ {
+		o, err := exec.Command("/usr/bin/env", "certutil", "-d", d, "-L", "-n", browserCertName, "-a").Output()
+		if err != nil {
+			return
+		}
+		exp, err := pemCertExpiry(o)
+		if err != nil || !remove(exp) {
+			return
+		}
+		if _, err := executeWithStdout("certutil", "-d", d, "-F", "-n", browserCertName); err != nil {
+			return
+		}
+		removed("browser certificate in "+db, exp)
+	}
+}
@@ -0,0 +1,165 @@
+// +build freebsd linux darwin
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func requireTools(t *testing.T, tools ...string) {
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+}
+
+// testPfx writes a PFX with a new self-signed certificate named like the
+// browser certificate and returns the certificate.
+func testPfx(t *testing.T, fp string, serial int64) *x509.Certificate {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "prodaccess test"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	kp := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	if err := writePfx(string(c), string(kp), fp, "-name", browserCertName); err != nil {
+		t.Fatalf("writePfx: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// nssCertificates returns the certificates in db with the browser
+// certificate nickname.
+func nssCertificates(t *testing.T, db string) []*x509.Certificate {
+	o, err := exec.Command("certutil", "-d", "sql:"+db, "-L", "-n", browserCertName, "-a").Output()
+	if err != nil {
+		return nil
+	}
+	certs := []*x509.Certificate{}
+	for {
+		var blk *pem.Block
+		blk, o = pem.Decode(o)
+		if blk == nil {
+			return certs
+		}
+		c, err := x509.ParseCertificate(blk.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, c)
+	}
+}
+
+func TestNSSImport(t *testing.T) {
+	requireTools(t, "certutil", "pk12util", "openssl")
+	td, err := ioutil.TempDir("", "nss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	db := filepath.Join(td, "nssdb")
+	if err := os.Mkdir(db, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if o, err := exec.Command("certutil", "-N", "--empty-password", "-d", "sql:"+db).CombinedOutput(); err != nil {
+		t.Fatalf("certutil -N: %v: %s", err, o)
+	}
+	pfx := filepath.Join(td, "browser.pfx")
+
+	first := testPfx(t, pfx, 1)
+	if err := nssImport(db, pfx); err != nil {
+		t.Fatalf("first import: %v", err)
+	}
+	if cs := nssCertificates(t, db); len(cs) != 1 || cs[0].SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Fatalf("after first import %s has %d certificates, want the first", browserCertName, len(cs))
+	}
+
+	second := testPfx(t, pfx, 2)
+	if err := nssImport(db, pfx); err != nil {
+		t.Fatalf("second import: %v", err)
+	}
+	cs := nssCertificates(t, db)
+	if len(cs) != 1 {
+		t.Fatalf("after replacing %s has %d certificates, want 1", browserCertName, len(cs))
+	}
+	if cs[0].SerialNumber.Cmp(second.SerialNumber) != 0 {
+		t.Errorf("%s is serial %v, want the replacement %v", browserCertName, cs[0].SerialNumber, second.SerialNumber)
+	}
+
+	removeNSS(db, expired)
+	if len(nssCertificates(t, db)) != 1 {
+		t.Errorf("gc removed a valid certificate")
+	}
+	removeNSS(db, always)
+	if cs := nssCertificates(t, db); len(cs) != 0 {
+		t.Errorf("logout left %d certificates", len(cs))
+	}
+}
+
+func TestFindNSSDatabases(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	for _, d := range []string{
+		".pki/nssdb",
+		".mozilla/firefox/abcd.default",
+	} {
+		if err := os.MkdirAll(filepath.Join(home, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(home, d, "cert9.db"), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Legacy databases are not supported.
+	if err := os.MkdirAll(filepath.Join(home, ".mozilla/firefox/old.default"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(home, ".mozilla/firefox/old.default/cert8.db"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dbs := findNSSDatabases(home)
+	want := []string{filepath.Join(home, ".pki/nssdb"), filepath.Join(home, ".mozilla/firefox/abcd.default")}
+	if len(dbs) != len(want) {
+		t.Fatalf("findNSSDatabases = %v, want %v", dbs, want)
+	}
+	for i := range want {
+		if dbs[i] != want[i] {
+			t.Errorf("findNSSDatabases = %v, want %v", dbs, want)
+		}
+	}
+}
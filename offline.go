@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	pb "github.com/dhtech/proto/auth"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/ssh"
+)
+
+// pendingRequest is what the machine making an offline request keeps until
+// the response is installed.
+type pendingRequest struct {
+	Keys         privateKeys `json:"keys"`
+	SSHPublicKey string      `json:"ssh_public_key,omitempty"`
+	// The kinds of credentials requested, nothing else is installed.
+	Requested []string `json:"requested"`
+}
+
+func defaultPendingRequest() string {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "prodaccess-pending.json"
+	}
+	return filepath.Join(d, "prodaccess", "pending.json")
+}
+
+// requestOffline writes the request login would send to out, for a machine
+// that cannot reach the auth server. The private keys stay in pending.
+func requestOffline(out string, pending string) error {
+	want := loginCredentials(wantedCredentials())
+	if !want.any() {
+		return printRequest(out, pending, want)
+	}
+	ucr, keys, err := newCredentialRequest(want)
+	if err != nil {
+		return err
+	}
+	b, err := proto.Marshal(ucr)
+	if err != nil {
+		return fmt.Errorf("could not encode request: %v", err)
+	}
+
+	p := pendingRequest{Keys: keys, Requested: []string{}}
+	if ucr.SshCertificateRequest != nil {
+		p.SSHPublicKey = ucr.SshCertificateRequest.PublicKey
+	}
+	for _, k := range credentialKinds {
+		if requested(ucr, k) {
+			p.Requested = append(p.Requested, k)
+		}
+	}
+	if ucr.KubernetesCertificateRequest != nil {
+		log.Printf("The auth server generates the Kubernetes private key, it will be in the response together with the certificate")
+	}
+	pj, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	pending = os.ExpandEnv(pending)
+	if err := os.MkdirAll(filepath.Dir(pending), 0700); err != nil {
+		return err
+	}
+	os.Remove(pending)
+	if err := ioutil.WriteFile(pending, pj, 0600); err != nil {
+		return fmt.Errorf("could not save private keys: %v", err)
+	}
+
+	if err := ioutil.WriteFile(out, b, 0644); err != nil {
+		return err
+	}
+	log.Printf("Wrote credential request to %s, submit it with \"prodaccess submit -in %s -out <response>\" from a machine that can reach %s",
+		out, filepath.Base(out), *grpcService)
+	return printRequest(out, pending, want)
+}
+
+// printRequest prints what request wrote with -output=json.
+func printRequest(out string, pending string, want credentialSet) error {
+	if !jsonOutput() {
+		return nil
+	}
+	r := struct {
+		Request   string   `json:"request,omitempty"`
+		Pending   string   `json:"pending,omitempty"`
+		Requested []string `json:"requested"`
+	}{Requested: []string{}}
+	for _, k := range credentialKinds {
+		if want.has(k) {
+			r.Requested = append(r.Requested, k)
+		}
+	}
+	if len(r.Requested) > 0 {
+		r.Request, r.Pending = out, pending
+	}
+	return writeJSON(r)
+}
+
+// submit sends a request written by requestOffline and writes the response
+// to out.
+func submit(in string, out string) error {
+	b, err := ioutil.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	ucr := &pb.UserCredentialRequest{}
+	if err := proto.Unmarshal(b, ucr); err != nil {
+		return fmt.Errorf("could not decode request %s: %v", in, err)
+	}
+
+	response, err := requestCredentials(ucr, nil)
+	if err != nil {
+		return err
+	}
+	b, err = proto.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("could not encode response: %v", err)
+	}
+	os.Remove(out)
+	if err := ioutil.WriteFile(out, b, 0600); err != nil {
+		return err
+	}
+	log.Printf("Wrote credentials to %s, install them with \"prodaccess install -in %s\" where the request was made. "+
+		"It holds secrets, remove it once installed.", out, filepath.Base(out))
+	if !jsonOutput() {
+		return nil
+	}
+	r := struct {
+		Response string   `json:"response"`
+		Issued   []string `json:"issued"`
+	}{out, []string{}}
+	for _, k := range credentialKinds {
+		if issued(response, k) {
+			r.Issued = append(r.Issued, k)
+		}
+	}
+	return writeJSON(r)
+}
+
+// installOffline installs a response written by submit, after checking that
+// it answers the request made here.
+func installOffline(in string, pending string) error {
+	b, err := ioutil.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	response := &pb.CredentialResponse{}
+	if err := proto.Unmarshal(b, response); err != nil {
+		return fmt.Errorf("could not decode response %s: %v", in, err)
+	}
+
+	pending = os.ExpandEnv(pending)
+	p := pendingRequest{}
+	b, err = ioutil.ReadFile(pending)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("refusing to install %s: no request was made here, %s does not exist", in, pending)
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return fmt.Errorf("could not parse %s: %v", pending, err)
+	}
+
+	if err := verifyResponse(response, p); err != nil {
+		return fmt.Errorf("refusing to install %s: %v", in, err)
+	}
+	got := credentialSet{}
+	for _, k := range credentialKinds {
+		if issued(response, k) {
+			got.set(k)
+		}
+	}
+	errs := installCredentials(response, p.Keys)
+	r := newLoginReport(got, nil, response, errs)
+	// Keep the private keys to retry with if anything failed.
+	failed := false
+	for _, err := range errs {
+		failed = failed || err != nil
+	}
+	if failed {
+		log.Printf("keeping the private keys in %s, install %s again to retry", pending, in)
+	} else {
+		os.Remove(pending)
+	}
+	garbageCollect()
+	return finishReport(r)
+}
+
+// verifyResponse checks that the certificates in r are for the keys in p
+// and valid.
+func verifyResponse(r *pb.CredentialResponse, p pendingRequest) error {
+	if r.RequiredAction != nil {
+		return fmt.Errorf("it is not a finished response")
+	}
+	for _, k := range credentialKinds {
+		if !issued(r, k) {
+			continue
+		}
+		found := false
+		for _, rk := range p.Requested {
+			found = found || rk == k
+		}
+		if !found {
+			return fmt.Errorf("it holds a %s credential, which was not requested here", k)
+		}
+	}
+
+	if r.SshCertificate != nil {
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.SshCertificate.Certificate))
+		if err != nil {
+			return fmt.Errorf("could not parse SSH certificate: %v", err)
+		}
+		cert, ok := k.(*ssh.Certificate)
+		if !ok {
+			return fmt.Errorf("SSH certificate is not a certificate")
+		}
+		own, _, _, _, err := ssh.ParseAuthorizedKey([]byte(p.SSHPublicKey))
+		if err != nil {
+			return fmt.Errorf("could not parse the requested SSH key: %v", err)
+		}
+		if !bytes.Equal(cert.Key.Marshal(), own.Marshal()) {
+			return fmt.Errorf("SSH certificate is not for the requested key")
+		}
+		if cert.ValidBefore != ssh.CertTimeInfinity && time.Unix(int64(cert.ValidBefore), 0).Before(time.Now()) {
+			return fmt.Errorf("SSH certificate has expired")
+		}
+	}
+
+	if kc := r.KubernetesCertificate; kc != nil {
+		if err := verifyCertificate(kc.Certificate, kc.PrivateKey); err != nil {
+			return fmt.Errorf("Kubernetes certificate: %v", err)
+		}
+	}
+	if r.VmwareCertificate != nil {
+		if err := verifyCertificate(r.VmwareCertificate.Certificate, p.Keys.VMware); err != nil {
+			return fmt.Errorf("VMware certificate: %v", err)
+		}
+	}
+	if r.BrowserCertificate != nil {
+		if err := verifyCertificate(r.BrowserCertificate.Certificate, p.Keys.Browser); err != nil {
+			return fmt.Errorf("browser certificate: %v", err)
+		}
+	}
+	return nil
+}
+
+func verifyCertificate(c string, k string) error {
+	if k == "" {
+		return fmt.Errorf("no private key for it, was it requested on this machine?")
+	}
+	if _, err := tls.X509KeyPair([]byte(c), []byte(k)); err != nil {
+		return err
+	}
+	exp, err := pemCertExpiry([]byte(c))
+	if err != nil {
+		return err
+	}
+	if exp.Before(time.Now()) {
+		return fmt.Errorf("expired %v", exp)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/dhtech/proto/auth"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestVerifyResponse(t *testing.T) {
+	k := testECDSAKey(t)
+	own, err := ssh.NewPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c := testSSHCertificate(t, k, uint64(time.Now().Add(time.Hour).Unix()))
+	_, other := testSSHCertificate(t, testECDSAKey(t), uint64(time.Now().Add(time.Hour).Unix()))
+	pending := pendingRequest{SSHPublicKey: string(ssh.MarshalAuthorizedKey(own)), Requested: []string{"ssh", "vault"}}
+
+	for _, tc := range []struct {
+		name string
+		r    *pb.CredentialResponse
+		p    pendingRequest
+		ok   bool
+	}{
+		{"requested", &pb.CredentialResponse{SshCertificate: &pb.SshCertificate{Certificate: c}, VaultToken: &pb.VaultToken{Token: "t"}}, pending, true},
+		{"other key", &pb.CredentialResponse{SshCertificate: &pb.SshCertificate{Certificate: other}}, pending, false},
+		{"no requested key", &pb.CredentialResponse{SshCertificate: &pb.SshCertificate{Certificate: c}}, pendingRequest{Requested: []string{"ssh"}}, false},
+		{"unparsable requested key", &pb.CredentialResponse{SshCertificate: &pb.SshCertificate{Certificate: c}}, pendingRequest{SSHPublicKey: "garbage", Requested: []string{"ssh"}}, false},
+		{"not requested", &pb.CredentialResponse{VaultToken: &pb.VaultToken{Token: "t"}}, pendingRequest{SSHPublicKey: pending.SSHPublicKey, Requested: []string{"ssh"}}, false},
+		{"unfinished", &pb.CredentialResponse{RequiredAction: &pb.RequiredAction{Url: "/login"}}, pending, false},
+	} {
+		err := verifyResponse(tc.r, tc.p)
+		if tc.ok && err != nil {
+			t.Errorf("%s: verifyResponse = %v", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: verifyResponse accepted the response", tc.name)
+		}
+	}
+}
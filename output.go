@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	outputFormat = flag.String("output", "text", "Output format: text, or json to print a JSON document on stdout and only logs on stderr")
+)
+
+func checkOutputFormat() error {
+	switch *outputFormat {
+	case "text":
+		return nil
+	case "json":
+		if *reportPath == "-" {
+			return fmt.Errorf("-report - cannot be combined with -output=json, which prints the report on stdout already")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown -output %q, use text or json", *outputFormat)
+}
+
+func jsonOutput() bool {
+	return *outputFormat == "json"
+}
+
+var (
+	jsonMu sync.Mutex
+	// Set once the JSON document has been printed.
+	jsonWritten bool
+)
+
+// writeJSON prints v as the JSON document on stdout.
+func writeJSON(v interface{}) error {
+	jsonMu.Lock()
+	defer jsonMu.Unlock()
+	jsonWritten = true
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
+
+// writeJSONError prints err as the JSON document with -output=json, unless
+// the command printed one already.
+func writeJSONError(err error) {
+	jsonMu.Lock()
+	written := jsonWritten
+	jsonMu.Unlock()
+	if !jsonOutput() || written {
+		return
+	}
+	writeJSON(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// fatalf logs and exits like log.Fatalf, printing the error as the JSON
+// document first with -output=json.
+func fatalf(format string, v ...interface{}) {
+	err := fmt.Errorf(format, v...)
+	writeJSONError(err)
+	log.Print(err)
+	exit(exitFailed)
+}
+
+// credentialPaths returns where a kind of credential is installed.
+func credentialPaths(kind string) []string {
+	switch kind {
+	case "vault":
+		return []string{os.ExpandEnv(*vaultTokenPath)}
+	case "kubernetes":
+		if *kubeExec {
+			return []string{os.ExpandEnv(*kubeCredentialCache), clientcmd.NewDefaultPathOptions().GetDefaultFilename()}
+		}
+		return []string{clientcmd.NewDefaultPathOptions().GetDefaultFilename()}
+	}
+	return platformPaths(kind)
+}
+
+// x509Fingerprint formats the SHA-256 fingerprint like openssl does.
+func x509Fingerprint(der []byte) string {
+	h := sha256.Sum256(der)
+	s := make([]string, len(h))
+	for i, b := range h {
+		s[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(s, ":")
+}
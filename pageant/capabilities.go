@@ -0,0 +1,50 @@
+package pageant
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// certificateExtension is announced by the PuTTY releases that load
+// certificates, 0.78 and later, which list them with it.
+const certificateExtension = "list-extended@putty.projects.tartarus.org"
+
+// Capabilities describes what a running Pageant supports.
+type Capabilities struct {
+	// Extensions announced by the agent in reply to the query extension.
+	Extensions []string
+	// StandardCertificates is true if certificates can be added with the
+	// OpenSSH SSH2_AGENTC_ADD_IDENTITY encoding. Otherwise this is our
+	// legacy patched Pageant that needs WriteHackCertificate.
+	StandardCertificates bool
+}
+
+// QueryCapabilities asks the agent which extensions it supports. Our patched
+// Pageant predates agent extensions and fails the query. Of the PuTTY
+// releases that answer it, only those announcing certificateExtension load
+// certificates the OpenSSH way.
+func QueryCapabilities(a agent.ExtendedAgent) Capabilities {
+	caps := Capabilities{}
+	resp, err := a.Extension("query", nil)
+	if err != nil || len(resp) == 0 || resp[0] != agentSuccess {
+		return caps
+	}
+
+	// The reply lists the extension names as SSH strings.
+	rest := resp[1:]
+	for len(rest) >= 4 {
+		n := binary.BigEndian.Uint32(rest)
+		if uint64(n) > uint64(len(rest)-4) {
+			break
+		}
+		caps.Extensions = append(caps.Extensions, string(rest[4:4+n]))
+		rest = rest[4+n:]
+	}
+	for _, e := range caps.Extensions {
+		if e == certificateExtension {
+			caps.StandardCertificates = true
+		}
+	}
+	return caps
+}
@@ -0,0 +1,51 @@
+package pageant
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func replyWith(reply []byte) agent.ExtendedAgent {
+	return agent.NewClient(&conn{query: func([]byte) ([]byte, error) {
+		return reply, nil
+	}})
+}
+
+func TestQueryCapabilities(t *testing.T) {
+	name := func(s string) []byte { return ssh.Marshal(struct{ S string }{s}) }
+	exts := append(name("query"), name("session-bind@openssh.com")...)
+	certExts := append(name("query"), name(certificateExtension)...)
+	for _, tc := range []struct {
+		name  string
+		reply []byte
+		want  Capabilities
+	}{
+		{"legacy", frame(5), Capabilities{}},
+		{"no extensions", frame(agentSuccess), Capabilities{}},
+		{"extensions", frame(append([]byte{agentSuccess}, exts...)...), Capabilities{
+			Extensions: []string{"query", "session-bind@openssh.com"},
+		}},
+		{"certificates", frame(append([]byte{agentSuccess}, certExts...)...), Capabilities{
+			Extensions:           []string{"query", certificateExtension},
+			StandardCertificates: true,
+		}},
+		{"truncated", frame(append([]byte{agentSuccess}, certExts[:len(certExts)-1]...)...), Capabilities{
+			Extensions: []string{"query"},
+		}},
+	} {
+		if got := QueryCapabilities(replyWith(tc.reply)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: QueryCapabilities = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestQueryCapabilitiesKeyring(t *testing.T) {
+	// An agent without extension support is treated as the legacy Pageant.
+	a := agent.NewClient(&conn{query: keyringQuery(t, agent.NewKeyring())})
+	if got := QueryCapabilities(a); got.StandardCertificates {
+		t.Errorf("QueryCapabilities = %+v, want legacy", got)
+	}
+}
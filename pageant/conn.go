@@ -0,0 +1,39 @@
+package pageant
+
+import (
+	"io"
+	"sync"
+)
+
+// conn turns a request/response transport into the stream expected by
+// agent.NewClient. Every Write is one complete request and its response is
+// buffered for the following Reads.
+type conn struct {
+	sync.Mutex
+	buf   []byte
+	query func([]byte) ([]byte, error)
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	resp, err := c.query(p)
+	if err != nil {
+		return 0, err
+	}
+	c.buf = append(c.buf, resp...)
+	return len(p), nil
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
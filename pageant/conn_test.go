@@ -0,0 +1,60 @@
+package pageant
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// keyringQuery returns a query function answered by an in-memory agent, as
+// Pageant would answer through shared memory.
+func keyringQuery(t *testing.T, kr agent.Agent) func([]byte) ([]byte, error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go agent.ServeAgent(kr, server)
+	return func(msg []byte) ([]byte, error) {
+		if err := checkRequest(msg); err != nil {
+			return nil, err
+		}
+		if _, err := client.Write(msg); err != nil {
+			return nil, err
+		}
+		return ReadMessage(client)
+	}
+}
+
+func TestConnAgentClient(t *testing.T) {
+	kr := agent.NewKeyring()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.Add(agent.AddedKey{PrivateKey: k, Comment: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	a := agent.NewClient(&conn{query: keyringQuery(t, kr)})
+	keys, err := a.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "test" {
+		t.Errorf("List = %v, want the test key", keys)
+	}
+}
+
+func TestConnQueryError(t *testing.T) {
+	want := errors.New("no pageant")
+	c := &conn{query: func([]byte) ([]byte, error) { return nil, want }}
+	if _, err := c.Write(frame(11)); err != want {
+		t.Errorf("Write = %v, want %v", err, want)
+	}
+	if n, err := c.Read(make([]byte, 4)); n != 0 || err == nil {
+		t.Errorf("Read after failed Write = %d, %v, want EOF", n, err)
+	}
+}
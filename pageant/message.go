@@ -0,0 +1,148 @@
+package pageant
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Maximum size of message can be sent to pageant
+const MaxMessageLen = 8192
+
+var (
+	ErrMessageTooLong       = errors.New("message too long")
+	ErrInvalidMessageFormat = errors.New("invalid message format")
+	ErrResponseTooLong      = errors.New("response too long")
+)
+
+const (
+	agentAddIdentity = 17
+	agentSuccess     = 6
+)
+
+// checkRequest verifies that msg is a single raw agent message with a
+// correct length prefix that fits in the Pageant shared memory.
+func checkRequest(msg []byte) error {
+	if len(msg) > MaxMessageLen {
+		return ErrMessageTooLong
+	}
+	if len(msg) < 4 {
+		return ErrInvalidMessageFormat
+	}
+	msgLen := binary.BigEndian.Uint32(msg[:4])
+	if uint64(len(msg)) != uint64(msgLen)+4 {
+		return ErrInvalidMessageFormat
+	}
+	return nil
+}
+
+// decodeResponse extracts the length prefixed response Pageant has written
+// to the start of buf.
+func decodeResponse(buf []byte) ([]byte, error) {
+	if len(buf) < 4 {
+		return nil, ErrInvalidMessageFormat
+	}
+	respLen := binary.BigEndian.Uint32(buf[:4])
+	if respLen > MaxMessageLen-4 || int(respLen)+4 > len(buf) {
+		return nil, ErrResponseTooLong
+	}
+
+	respData := make([]byte, respLen+4)
+	copy(respData, buf)
+	return respData, nil
+}
+
+// ReadMessage reads one raw agent message and returns it with its length
+// prefix.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > MaxMessageLen-4 {
+		return nil, ErrResponseTooLong
+	}
+	msg := make([]byte, 4+n)
+	copy(msg, l[:])
+	if _, err := io.ReadFull(r, msg[4:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+type loadHackCertificateMsg struct {
+	Type    string `sshtype:"17"`
+	Keyblob []byte
+	Comment string
+}
+
+// marshalHackCertificate encodes an OpenSSH certificate in authorized_keys
+// format as a length prefixed add identity request for our patched Pageant.
+func marshalHackCertificate(c string) ([]byte, error) {
+	// TODO(bluecmd): Since the PuTTY maintainers doesn't want to add
+	// support for user certificates right now, we have hacked in support
+	// in our own Pageant. The way to load certificates into that version
+	// is not compatible with the OpenSSH wire format, so we do it ad-hoc here.
+	// The format is:
+	// - Length (BE 4 byte)
+	// - Message type (SSH2_AGENTC_ADD_IDENTITY, 17, 1 byte)
+	// - Algorithm name length (BE 4 byte)
+	// - Algorithm name ("blablaba-cert-v01@openssh.com", string)
+	// - Keyblob (The classical "middle field" of the openssh keys)
+	// - Comment length (BE 4 byte)
+	// - Comment ("my comment", string)
+
+	parts := strings.SplitN(strings.TrimSpace(c), " ", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("malformed certificate, expected \"<type> <base64> [comment]\"")
+	}
+	t := parts[0]
+	blob := parts[1]
+	comment := ""
+	if len(parts) > 2 {
+		comment = parts[2]
+	}
+
+	bblob, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return nil, fmt.Errorf("base64 decode error on certificate: %v", err)
+	}
+
+	req := ssh.Marshal(loadHackCertificateMsg{Type: t, Keyblob: bblob, Comment: comment})
+	if len(req)+4 > MaxMessageLen {
+		return nil, ErrMessageTooLong
+	}
+	msg := make([]byte, 4+len(req))
+	binary.BigEndian.PutUint32(msg, uint32(len(req)))
+	copy(msg[4:], req)
+	return msg, nil
+}
+
+// WriteHackCertificate sends an OpenSSH certificate in authorized_keys format
+// to our patched Pageant, reached through rw, and waits for the reply.
+func WriteHackCertificate(rw io.ReadWriter, c string) error {
+	msg, err := marshalHackCertificate(c)
+	if err != nil {
+		return err
+	}
+	if _, err := rw.Write(msg); err != nil {
+		return err
+	}
+
+	// The reply is always (AFAIK) 1 byte status code, so ignore everything else.
+	resp, err := ReadMessage(rw)
+	if err != nil {
+		return err
+	}
+
+	if len(resp) < 5 || resp[4] != agentSuccess {
+		return fmt.Errorf("Pageant returned error %v", resp[4:])
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package pageant
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testCertificate(t testing.TB) string {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: []string{"test"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))) + " test@example"
+}
+
+func frame(b ...byte) []byte {
+	msg := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(msg, uint32(len(b)))
+	copy(msg[4:], b)
+	return msg
+}
+
+func TestMarshalHackCertificate(t *testing.T) {
+	c := testCertificate(t)
+	msg, err := marshalHackCertificate(c)
+	if err != nil {
+		t.Fatalf("marshalHackCertificate: %v", err)
+	}
+	if err := checkRequest(msg); err != nil {
+		t.Fatalf("checkRequest: %v", err)
+	}
+	if msg[4] != agentAddIdentity {
+		t.Errorf("message type = %d, want %d", msg[4], agentAddIdentity)
+	}
+
+	var got loadHackCertificateMsg
+	if err := ssh.Unmarshal(msg[4:], &got); err != nil {
+		t.Fatalf("ssh.Unmarshal: %v", err)
+	}
+	parts := strings.SplitN(c, " ", 3)
+	if got.Type != parts[0] {
+		t.Errorf("type = %q, want %q", got.Type, parts[0])
+	}
+	if got.Comment != "test@example" {
+		t.Errorf("comment = %q, want %q", got.Comment, "test@example")
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Keyblob, pk.Marshal()) {
+		t.Errorf("keyblob does not match the certificate")
+	}
+}
+
+func TestMarshalHackCertificateMalformed(t *testing.T) {
+	for _, c := range []string{
+		"",
+		"ecdsa-sha2-nistp256-cert-v01@openssh.com",
+		"ecdsa-sha2-nistp256-cert-v01@openssh.com not-base64!",
+		"ecdsa-sha2-nistp256-cert-v01@openssh.com " + strings.Repeat("QUFB", MaxMessageLen),
+	} {
+		if _, err := marshalHackCertificate(c); err == nil {
+			t.Errorf("marshalHackCertificate(%.40q) succeeded, want error", c)
+		}
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+		want error
+	}{
+		{"valid", frame(11), nil},
+		{"empty body", frame(), nil},
+		{"short", []byte{0, 0}, ErrInvalidMessageFormat},
+		{"length too big", append(frame(11), 0), ErrInvalidMessageFormat},
+		{"length too small", frame(11)[:4], ErrInvalidMessageFormat},
+		{"too long", frame(make([]byte, MaxMessageLen)...), ErrMessageTooLong},
+	} {
+		if got := checkRequest(tc.msg); got != tc.want {
+			t.Errorf("%s: checkRequest() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	buf := make([]byte, MaxMessageLen)
+	copy(buf, frame(agentSuccess))
+	got, err := decodeResponse(buf)
+	if err != nil {
+		t.Fatalf("decodeResponse: %v", err)
+	}
+	if !bytes.Equal(got, frame(agentSuccess)) {
+		t.Errorf("decodeResponse = %v, want %v", got, frame(agentSuccess))
+	}
+
+	binary.BigEndian.PutUint32(buf, MaxMessageLen)
+	if _, err := decodeResponse(buf); err != ErrResponseTooLong {
+		t.Errorf("decodeResponse with oversized length = %v, want %v", err, ErrResponseTooLong)
+	}
+	if _, err := decodeResponse(buf[:3]); err != ErrInvalidMessageFormat {
+		t.Errorf("decodeResponse with short buffer = %v, want %v", err, ErrInvalidMessageFormat)
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	r := bytes.NewReader(append(frame(1, 2, 3), frame(4)...))
+	for _, want := range [][]byte{frame(1, 2, 3), frame(4)} {
+		got, err := ReadMessage(r)
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("ReadMessage = %v, want %v", got, want)
+		}
+	}
+	if _, err := ReadMessage(r); err != io.EOF {
+		t.Errorf("ReadMessage at end = %v, want EOF", err)
+	}
+	if _, err := ReadMessage(bytes.NewReader(frame(1, 2, 3)[:5])); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadMessage of truncated message = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+type fakePageant struct {
+	req   bytes.Buffer
+	reply *bytes.Reader
+}
+
+func (f *fakePageant) Write(p []byte) (int, error) { return f.req.Write(p) }
+func (f *fakePageant) Read(p []byte) (int, error)  { return f.reply.Read(p) }
+
+func TestWriteHackCertificate(t *testing.T) {
+	c := testCertificate(t)
+	want, err := marshalHackCertificate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakePageant{reply: bytes.NewReader(frame(agentSuccess))}
+	if err := WriteHackCertificate(f, c); err != nil {
+		t.Errorf("WriteHackCertificate: %v", err)
+	}
+	if !bytes.Equal(f.req.Bytes(), want) {
+		t.Errorf("WriteHackCertificate sent %v, want %v", f.req.Bytes(), want)
+	}
+
+	// SSH_AGENT_FAILURE
+	f = &fakePageant{reply: bytes.NewReader(frame(5))}
+	if err := WriteHackCertificate(f, c); err == nil {
+		t.Errorf("WriteHackCertificate succeeded on failure reply")
+	}
+
+	f = &fakePageant{reply: bytes.NewReader(frame())}
+	if err := WriteHackCertificate(f, c); err == nil {
+		t.Errorf("WriteHackCertificate succeeded on empty reply")
+	}
+}
+
+func FuzzMarshalHackCertificate(f *testing.F) {
+	f.Add(testCertificate(f))
+	f.Add("")
+	f.Add("ssh-ed25519")
+	f.Add("ssh-ed25519 AAAA comment with spaces")
+	f.Fuzz(func(t *testing.T, c string) {
+		msg, err := marshalHackCertificate(c)
+		if err != nil {
+			return
+		}
+		if err := checkRequest(msg); err != nil {
+			t.Errorf("marshalHackCertificate(%q) produced invalid request: %v", c, err)
+		}
+	})
+}
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add(frame(agentSuccess))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, err := ReadMessage(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		if err := checkRequest(msg); err != nil {
+			t.Errorf("ReadMessage(%v) returned invalid message: %v", b, err)
+		}
+	})
+}
+
+func FuzzDecodeResponse(f *testing.F) {
+	f.Add(frame(agentSuccess))
+	f.Add([]byte{0, 0, 0, 9, 1})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		resp, err := decodeResponse(b)
+		if err != nil {
+			return
+		}
+		if err := checkRequest(resp); err != nil {
+			t.Errorf("decodeResponse(%v) returned invalid message: %v", b, err)
+		}
+	})
+}
@@ -25,37 +25,24 @@ package pageant
 // see https://github.com/paramiko/paramiko/blob/master/paramiko/win_pageant.py
 
 import (
-	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"strings"
 	"sync"
 	. "syscall"
 	"unsafe"
 
-	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
-// Maximum size of message can be sent to pageant
-const MaxMessageLen = 8192
-
 var (
 	ErrPageantNotFound = errors.New("pageant process not found")
 	ErrSendMessage     = errors.New("error sending message")
-
-	ErrMessageTooLong       = errors.New("message too long")
-	ErrInvalidMessageFormat = errors.New("invalid message format")
-	ErrResponseTooLong      = errors.New("response too long")
 )
 
 const (
-	agentAddIdentity = 17
-	agentCopydataID  = 0x804e50ba
-	agentSuccess     = 6
-	wmCopydata       = 74
+	agentCopydataID = 0x804e50ba
+	wmCopydata      = 74
 )
 
 type copyData struct {
@@ -84,13 +71,8 @@ func Available() bool { return pageantWindow() != 0 }
 // 'msg' is raw agent request with length prefix
 // Response is raw agent response with length prefix
 func query(msg []byte) ([]byte, error) {
-	if len(msg) > MaxMessageLen {
-		return nil, ErrMessageTooLong
-	}
-
-	msgLen := binary.BigEndian.Uint32(msg[:4])
-	if len(msg) != int(msgLen)+4 {
-		return nil, ErrInvalidMessageFormat
+	if err := checkRequest(msg); err != nil {
+		return nil, err
 	}
 
 	lock.Lock()
@@ -136,15 +118,7 @@ func query(msg []byte) ([]byte, error) {
 		return nil, ErrSendMessage
 	}
 
-	respLen := binary.BigEndian.Uint32(mmSlice[:4])
-	if respLen > MaxMessageLen-4 {
-		return nil, ErrResponseTooLong
-	}
-
-	respData := make([]byte, respLen+4)
-	copy(respData, mmSlice)
-
-	return respData, nil
+	return decodeResponse(mmSlice)
 }
 
 func pageantWindow() uintptr {
@@ -155,92 +129,28 @@ func pageantWindow() uintptr {
 
 type PageantAgent struct {
 	c *conn
-	agent.Agent
+	agent.ExtendedAgent
 }
 
 // New returns new ssh-agent instance (see http://golang.org/x/crypto/ssh/agent)
 func New() *PageantAgent {
-	c := &conn{}
+	c := &conn{query: query}
 	return &PageantAgent{c, agent.NewClient(c)}
 }
 
-type conn struct {
-	sync.Mutex
-	buf []byte
+// NewConn returns a connection that forwards raw, length prefixed, agent
+// messages to Pageant.
+func NewConn() io.ReadWriter {
+	return &conn{query: query}
 }
 
-func (c *conn) Write(p []byte) (int, error) {
-	c.Lock()
-	defer c.Unlock()
-
-	resp, err := query(p)
-	if err != nil {
-		return 0, err
-	}
-	c.buf = append(c.buf, resp...)
-	return len(p), nil
-}
-
-func (c *conn) Read(p []byte) (int, error) {
-	c.Lock()
-	defer c.Unlock()
-
-	if len(c.buf) == 0 {
-		return 0, io.EOF
-	}
-	n := copy(p, c.buf)
-	c.buf = c.buf[n:]
-	return n, nil
-}
-
-type loadHackCertificateMsg struct {
-	Type        string `sshtype:"17"`
-	Keyblob     []byte
-	Comment     string
+// Capabilities queries what the running Pageant supports.
+func (p *PageantAgent) Capabilities() Capabilities {
+	return QueryCapabilities(p)
 }
 
+// LoadHackCertificate loads an OpenSSH certificate for a key already held
+// by our patched Pageant, see WriteHackCertificate.
 func (p *PageantAgent) LoadHackCertificate(c string) error {
-	// TODO(bluecmd): Since the PuTTY maintainers doesn't want to add
-	// support for user certificates right now, we have hacked in support
-	// in our own Pageant. The way to load certificates into that version
-	// is not compatible with the OpenSSH wire format, so we do it ad-hoc here.
-	// The format is:
-	// - Length (BE 4 byte)
-	// - Message type (SSH2_AGENTC_ADD_IDENTITY, 17, 1 byte)
-	// - Algorithm name length (BE 4 byte)
-	// - Algorithm name ("blablaba-cert-v01@openssh.com", string)
-	// - Keyblob (The classical "middle field" of the openssh keys)
-	// - Comment length (BE 4 byte)
-	// - Comment ("my comment", string)
-
-	parts := strings.SplitN(c, " ", 3)
-	t := parts[0]
-	blob := parts[1]
-	comment := ""
-	if len(parts) > 2 {
-		comment = parts[2]
-	}
-
-	bblob, err := base64.StdEncoding.DecodeString(blob)
-	if err != nil {
-		return fmt.Errorf("base64 decode error on certificate: %v", err)
-	}
-
-	req := ssh.Marshal(loadHackCertificateMsg{Type: t, Keyblob: bblob, Comment: comment})
-	msg := make([]byte, 4 + len(req))
-	binary.BigEndian.PutUint32(msg, uint32(len(req)))
-	copy(msg[4:], req)
-	p.c.Write(msg)
-
-	// The reply is always (AFAIK) 1 byte status code, so ignore everything else.
-	resp := make([]byte, 5)
-	n, err := p.c.Read(resp)
-	if err != nil {
-		return err
-	}
-
-	if n != 5 || resp[4] != agentSuccess {
-		return fmt.Errorf("Pageant returned error %v", resp[4])
-	}
-	return nil
+	return WriteHackCertificate(p.c, c)
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	parallelism = flag.Int("parallelism", 4, "How many keys to generate or credentials to install at the same time")
+)
+
+// errorList collects the errors of steps that do not depend on each other.
+type errorList []error
+
+func (e errorList) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// asError returns nil if there are no errors.
+func (e errorList) asError() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// task is a named step that can run concurrently with others.
+type task struct {
+	name string
+	run  func() error
+}
+
+// runTasks runs the tasks, at most -parallelism at a time, and returns
+// their errors in the order they were given.
+func runTasks(tasks []task) []error {
+	n := *parallelism
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	errs := make([]error, len(tasks))
+	var wg sync.WaitGroup
+	for i, t := range tasks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, t task) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = t.run()
+		}(i, t)
+	}
+	wg.Wait()
+	return errs
+}
+
+// runParallel runs the tasks like runTasks and returns the errors of those
+// that failed.
+func runParallel(tasks []task) error {
+	failed := errorList{}
+	for i, err := range runTasks(tasks) {
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %v", tasks[i].name, err))
+		}
+	}
+	return failed.asError()
+}
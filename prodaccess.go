@@ -10,30 +10,36 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	url "github.com/dhtech/go-openurl"
+	pb "github.com/dhtech/proto/auth"
 	"github.com/google/uuid"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
-	pb "github.com/dhtech/proto/auth"
 )
 
 var (
-	grpcService    = flag.String("grpc", "auth.tech.dreamhack.se:443", "Authentication server to use.")
-	tlsServerName  = flag.String("server_name", "auth.tech.dreamhack.se", "TLS server name to verify.")
-	useTls         = flag.Bool("tls", true, "Whether or not to use TLS for the GRPC connection")
-	webUrl         = flag.String("web", "https://auth.tech.dreamhack.se", "Domain to reply to ident requests from")
-	requestVmware  = flag.Bool("vmware", false, "Whether or not to request a VMware certificate")
-	// TODO(bluecmd): This should be automatic
-	requestBrowser = flag.Bool("browser", false, "Whether or not to request a browser certificate")
-	rsaKeySize     = flag.Int("rsa_key_size", 4096, "When generating RSA keys, use this key size")
-	ident          = ""
+	grpcService        = flag.String("grpc", "auth.tech.dreamhack.se:443", "Authentication server to use.")
+	tlsServerName      = flag.String("server_name", "auth.tech.dreamhack.se", "TLS server name to verify.")
+	useTls             = flag.Bool("tls", true, "Whether or not to use TLS for the GRPC connection")
+	webUrl             = flag.String("web", "https://auth.tech.dreamhack.se", "Domain to reply to ident requests from")
+	requestSSH         = flag.Bool("ssh", true, "Whether or not to request an SSH certificate")
+	requestVault       = flag.Bool("vault", true, "Whether or not to request a Vault token")
+	requestVmware      = flag.Bool("vmware", false, "Whether or not to request a VMware certificate")
+	requestBrowser     = newAutoBool("browser", "Whether or not to request a browser certificate, or auto to detect if one is needed")
+	browserRenewBefore = flag.Duration("browser_renew_before", 24*time.Hour, "Renew the browser certificate when it expires within this duration")
+	forceRequest       = flag.Bool("force", false, "Request all credentials, also those that are still valid")
+	rsaKeySize         = flag.Int("rsa_key_size", 4096, "When generating RSA keys, use this key size")
+	ident              = ""
+	identMu            sync.Mutex
+	identServer        *http.Server
 )
 
 func presentIdent(w http.ResponseWriter, r *http.Request) {
@@ -46,13 +52,67 @@ func quit(w http.ResponseWriter, r *http.Request) {
 	// This is used to kill any other prodaccess that is lingering, enforcing
 	// that only one is running.
 	log.Printf("Got termination request by /quit")
-	os.Exit(0)
+	exit(0)
 }
 
-func mustServeHttp() {
-	err := http.ListenAndServe(":1215", nil)
-	if err != nil {
-		log.Fatalf("could not serve backend http: %v", err)
+var (
+	exitMu    sync.Mutex
+	exitHooks []func()
+)
+
+// atExit registers f to run when prodaccess exits through exit, which the
+// deferred functions of main do not.
+func atExit(f func()) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	exitHooks = append(exitHooks, f)
+}
+
+// exit runs the functions registered with atExit and exits with code.
+func exit(code int) {
+	exitMu.Lock()
+	for i := len(exitHooks) - 1; i >= 0; i-- {
+		exitHooks[i]()
+	}
+	os.Exit(code)
+}
+
+// startIdentServer replaces any other running prodaccess as the ident
+// server. It is started once and then used for all requests.
+func startIdentServer() {
+	identMu.Lock()
+	defer identMu.Unlock()
+	if identServer != nil {
+		return
+	}
+
+	// Attempt to kill any already running prodaccess
+	http.Get("http://localhost:1215/quit")
+
+	// Create ident server, used to validate requests to protect from crosslinking.
+	ident = uuid.New().String()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", presentIdent)
+	mux.HandleFunc("/quit", quit)
+	identServer = &http.Server{Addr: ":1215", Handler: mux}
+	go mustServeHttp(identServer)
+}
+
+// stopIdentServer stops the ident server, so that this prodaccess is not
+// replaced by the next one.
+func stopIdentServer() {
+	identMu.Lock()
+	defer identMu.Unlock()
+	if identServer != nil {
+		identServer.Close()
+		identServer = nil
+	}
+}
+
+func mustServeHttp(s *http.Server) {
+	err := s.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		fatalf("could not serve backend http: %v", err)
 	}
 }
 
@@ -71,7 +131,7 @@ func generateEcdsaCsr() (string, string, error) {
 		CommonName: "replaced-by-the-server",
 	}
 	tmpl := x509.CertificateRequest{
-		Subject: subj,
+		Subject:            subj,
 		SignatureAlgorithm: x509.ECDSAWithSHA256,
 	}
 	csrb, _ := x509.CreateCertificateRequest(rand.Reader, &tmpl, keyb)
@@ -92,7 +152,7 @@ func generateRsaCsr() (string, string, error) {
 		CommonName: "replaced-by-the-server",
 	}
 	tmpl := x509.CertificateRequest{
-		Subject: subj,
+		Subject:            subj,
 		SignatureAlgorithm: x509.SHA256WithRSA,
 	}
 	csrb, _ := x509.CreateCertificateRequest(rand.Reader, &tmpl, keyb)
@@ -101,123 +161,302 @@ func generateRsaCsr() (string, string, error) {
 	return string(keyPemBlob), string(pemBlob), nil
 }
 
-func main() {
-	flag.Parse()
-
-	// Attempt to kill any already running prodaccess
-	http.Get("http://localhost:1215/quit")
-
-	// Create ident server, used to validate requests to protect from crosslinking.
-	ident = uuid.New().String()
-	http.HandleFunc("/", presentIdent)
-	http.HandleFunc("/quit", quit)
-	go mustServeHttp()
-
+func dial(ctx context.Context, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	certs, err := clientCertificates()
+	if err != nil {
+		return nil, err
+	}
 	d := grpc.WithInsecure()
 	if *useTls {
 		d = grpc.WithTransportCredentials(
 			credentials.NewTLS(&tls.Config{
-				ServerName: *tlsServerName,
+				ServerName:   *tlsServerName,
+				Certificates: certs,
 			}),
 		)
+	} else if certs != nil {
+		return nil, fmt.Errorf("a client certificate requires -tls")
+	}
+	return grpc.DialContext(ctx, *grpcService, append(opts, d)...)
+}
+
+// requestCredentials sends the credential request and follows any required
+// actions until the server replies with the issued credentials. onAction, if
+// not nil, is called with the URL of every distinct required action.
+func requestCredentials(ucr *pb.UserCredentialRequest, onAction func(url string)) (*pb.CredentialResponse, error) {
+	sa := serviceAccount()
+	if !sa {
+		startIdentServer()
+		ucr.ClientValidation = &pb.ClientValidation{
+			Ident: ident,
+		}
 	}
 
-	conn, err := grpc.Dial(*grpcService, d)
+	ctx, cancel := context.WithTimeout(context.Background(), *requestTimeout)
+	defer cancel()
+	ctx, err := serviceAccountContext(ctx)
 	if err != nil {
-		log.Printf("could not connect: %v", err)
-		conn = nil
+		return nil, err
 	}
 
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect: %v", err)
+	}
 	defer conn.Close()
 	c := pb.NewAuthenticationServiceClient(conn)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
-
-	ucr := &pb.UserCredentialRequest{
-			ClientValidation: &pb.ClientValidation{
-				Ident: ident,
-			},
-			VaultTokenRequest: &pb.VaultTokenRequest{},
+	log.Printf("Sending credential request")
+	stream, err := c.RequestUserCredential(ctx, ucr)
+	if err != nil {
+		return nil, fmt.Errorf("could not request credentials: %v", err)
 	}
 
-	vmwarePk := ""
-	if *requestVmware {
-		csr := ""
-		log.Printf("Generating VMware CSR ...")
-		vmwarePk, csr, err = generateEcdsaCsr()
+	d := newActionDispatcher(ctx, sa, onAction)
+	for {
+		response, err := stream.Recv()
 		if err != nil {
-			log.Fatalf("failed to generate VMware CSR: %v", err)
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("no credentials within %v: %v", *requestTimeout, err)
+			}
+			return nil, err
+		}
+		if response.RequiredAction == nil {
+			return response, nil
 		}
-		ucr.VmwareCertificateRequest = &pb.VmwareCertificateRequest{
-			Csr: csr,
+		if err := d.dispatch(response.RequiredAction); err != nil {
+			return nil, err
 		}
 	}
+}
 
-	browserPk := ""
-	if *requestBrowser {
-		csr := ""
-		log.Printf("Generating Browser CSR ...")
-		browserPk, csr, err = generateEcdsaCsr()
-		if err != nil {
-			log.Fatalf("failed to generate Browser CSR: %v", err)
+// pemCertificate returns the first certificate in a PEM blob.
+func pemCertificate(p []byte) (*x509.Certificate, error) {
+	for {
+		var blk *pem.Block
+		blk, p = pem.Decode(p)
+		if blk == nil {
+			return nil, fmt.Errorf("no certificate found")
 		}
-		ucr.BrowserCertificateRequest = &pb.BrowserCertificateRequest{
-			Csr: csr,
+		if blk.Type != "CERTIFICATE" {
+			continue
 		}
+		return x509.ParseCertificate(blk.Bytes)
 	}
+}
 
-	if hasKubectl() {
+// pemCertExpiry returns the expiry of the first certificate in a PEM blob.
+func pemCertExpiry(p []byte) (time.Time, error) {
+	cert, err := pemCertificate(p)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// wantBrowserCertificate decides whether to request a browser certificate.
+// Unless told explicitly, it is requested if there is one already or if a
+// browser profile that we know how to install into is found.
+func wantBrowserCertificate() bool {
+	if v, ok := requestBrowser.Get(); ok {
+		return v
+	}
+	if _, err := browserCertificateExpiry(); err == nil {
+		return true
+	}
+	return hasBrowserProfile()
+}
+
+// credentialSet selects which credentials to request.
+type credentialSet struct {
+	SSH        bool
+	Vault      bool
+	Kubernetes bool
+	VMware     bool
+	Browser    bool
+}
+
+func (c credentialSet) any() bool {
+	return c.SSH || c.Vault || c.Kubernetes || c.VMware || c.Browser
+}
+
+// wantedCredentials returns the credentials a plain login requests.
+func wantedCredentials() credentialSet {
+	return credentialSet{
+		SSH:        *requestSSH,
+		Vault:      *requestVault,
+		Kubernetes: wantKubernetesCertificate(),
+		VMware:     *requestVmware,
+		Browser:    wantBrowserCertificate(),
+	}
+}
+
+// privateKeys are the keys generated for the certificate requests, they never
+// leave this machine.
+type privateKeys struct {
+	VMware  string `json:"vmware,omitempty"`
+	Browser string `json:"browser,omitempty"`
+}
+
+// newCredentialRequest generates the keys and builds the request for the
+// selected credentials.
+func newCredentialRequest(want credentialSet) (*pb.UserCredentialRequest, privateKeys, error) {
+	ucr := &pb.UserCredentialRequest{}
+	keys := privateKeys{}
+
+	if want.Vault {
+		ucr.VaultTokenRequest = &pb.VaultTokenRequest{}
+	}
+
+	if want.Kubernetes {
 		ucr.KubernetesCertificateRequest = &pb.KubernetesCertificateRequest{}
 	}
 
-	sshPkey, err := sshGetPublicKey()
-	if err == nil {
-		ucr.SshCertificateRequest = &pb.SshCertificateRequest{
-			PublicKey: sshPkey,
-		}
+	// Every task sets its own fields.
+	tasks := []task{}
+	if want.VMware {
+		tasks = append(tasks, task{"VMware CSR", func() error {
+			log.Printf("Generating VMware CSR ...")
+			k, csr, err := generateEcdsaCsr()
+			if err != nil {
+				return err
+			}
+			keys.VMware = k
+			ucr.VmwareCertificateRequest = &pb.VmwareCertificateRequest{
+				Csr: csr,
+			}
+			return nil
+		}})
 	}
 
-	log.Printf("Sending credential request")
-	stream, err := c.RequestUserCredential(ctx, ucr)
-	if err != nil {
-		log.Fatalf("could not request credentials: %v", err)
+	if want.Browser {
+		tasks = append(tasks, task{"Browser CSR", func() error {
+			log.Printf("Generating Browser CSR ...")
+			k, csr, err := generateEcdsaCsr()
+			if err != nil {
+				return err
+			}
+			keys.Browser = k
+			ucr.BrowserCertificateRequest = &pb.BrowserCertificateRequest{
+				Csr: csr,
+			}
+			return nil
+		}})
 	}
 
-	response, err := stream.Recv()
-	for {
-		if (err != nil) {
-			log.Printf("Error: %v", err)
-			break
-		}
-		if (response.RequiredAction != nil) {
-			log.Printf("Required action: %v", response.RequiredAction)
-			url.Open(*webUrl + response.RequiredAction.Url)
-		} else {
-			break
-		}
-		response, err = stream.Recv()
+	if want.SSH {
+		tasks = append(tasks, task{"SSH public key", func() error {
+			// Without a key the other credentials are still requested.
+			sshPkey, err := sshGetPublicKey()
+			if err == nil {
+				ucr.SshCertificateRequest = &pb.SshCertificateRequest{
+					PublicKey: sshPkey,
+				}
+			}
+			return nil
+		}})
+	}
+
+	if err := runParallel(tasks); err != nil {
+		return nil, keys, fmt.Errorf("failed to generate keys: %v", err)
+	}
+	return ucr, keys, nil
+}
+
+// installCredentials installs the issued credentials, keys holds the private
+// keys of the certificates requested with a CSR. It returns the result of
+// installing each kind of credential.
+func installCredentials(response *pb.CredentialResponse, keys privateKeys) map[string]error {
+	kinds := []string{}
+	tasks := []task{}
+	add := func(kind string, name string, f func() error) {
+		kinds = append(kinds, kind)
+		tasks = append(tasks, task{name, f})
 	}
 
 	if response.SshCertificate != nil {
-		sshLoadCertificate(response.SshCertificate.Certificate)
+		add("ssh", "SSH certificate", func() error {
+			return sshLoadCertificate(response.SshCertificate.Certificate)
+		})
 	}
 
 	if response.VaultToken != nil {
-		saveVaultToken(response.VaultToken.Token)
+		add("vault", "Vault token", func() error {
+			return saveVaultToken(response.VaultToken.Token)
+		})
 	}
 
 	if response.KubernetesCertificate != nil {
-		saveKubernetesCertificate(response.KubernetesCertificate.Certificate, response.KubernetesCertificate.PrivateKey)
+		add("kubernetes", "Kubernetes certificate", func() error {
+			return saveKubernetesCertificate(response.KubernetesCertificate.Certificate, response.KubernetesCertificate.PrivateKey)
+		})
 	}
 
 	if response.VmwareCertificate != nil {
-		full := append([]string{response.VmwareCertificate.Certificate}, response.VmwareCertificate.CaChain...)
-		saveVmwareCertificate(strings.Join(full, "\n"), vmwarePk)
+		add("vmware", "VMware certificate", func() error {
+			full := append([]string{response.VmwareCertificate.Certificate}, response.VmwareCertificate.CaChain...)
+			return saveVmwareCertificate(strings.Join(full, "\n"), keys.VMware)
+		})
 	}
 
 	if response.BrowserCertificate != nil {
-		full := append([]string{response.BrowserCertificate.Certificate}, response.BrowserCertificate.CaChain...)
-		saveBrowserCertificate(strings.Join(full, "\n"), browserPk)
+		add("browser", "Browser certificate", func() error {
+			full := append([]string{response.BrowserCertificate.Certificate}, response.BrowserCertificate.CaChain...)
+			return saveBrowserCertificate(strings.Join(full, "\n"), keys.Browser)
+		})
 	}
+
+	errs := map[string]error{}
+	for i, err := range runTasks(tasks) {
+		errs[kinds[i]] = err
+	}
+	return errs
+}
+
+// sessionMode is set by shell and exec, whose login must leave the user's
+// own credentials alone.
+var sessionMode bool
+
+// login requests the selected credentials and installs them.
+func login(want credentialSet) *loginReport {
+	// Replace any other prodaccess while the keys are generated.
+	if !serviceAccount() {
+		go startIdentServer()
+	}
+
+	ucr, keys, err := newCredentialRequest(want)
+	if err != nil {
+		r := newLoginReport(want, nil, nil, nil)
+		r.Error = err.Error()
+		return r
+	}
+
+	actions := []string{}
+	response, err := requestCredentials(ucr, func(url string) {
+		actions = append(actions, url)
+	})
+	if err != nil {
+		r := newLoginReport(want, ucr, nil, nil)
+		r.RequiredActions = actions
+		r.Error = err.Error()
+		for i := range r.Credentials {
+			if r.Credentials[i].Error == "" {
+				r.Credentials[i].Error = "request failed"
+			}
+		}
+		return r
+	}
+
+	r := newLoginReport(want, ucr, response, installCredentials(response, keys))
+	r.RequiredActions = actions
+	if !sessionMode {
+		garbageCollect()
+	}
+	return r
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	os.Exit(runCommand(flag.Args()))
 }
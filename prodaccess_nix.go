@@ -4,16 +4,21 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
-	"golang.org/x/sys/unix"
+	"github.com/dhtech/prodaccess/sshagent"
+	"github.com/dhtech/prodaccess/wsl"
+	"golang.org/x/crypto/ssh"
 )
 
 var (
@@ -27,134 +32,225 @@ var (
 	certAuthority = "@cert-authority *.event.dreamhack.se ecdsa-sha2-nistp521 AAAAE2VjZHNhLXNoYTItbmlzdHA1MjEAAAAIbmlzdHA1MjEAAACFBAC/xT7a8A4Gm1Tf0mpKstqncWsOZpGPKa0lqf7EuYSpWUnx5QLaiP2TcI80AELTw2gP9jzOkpN7/QO91V3edRXGLAGk3NiNZLqvJspYfAnEo9f3/E4GBZf4kcDC93+04SzbFg+qMY3iCmJNaIttUMdQwaR22c+HbOYhaGEFWN3OCa6Erw== vault@tech.dreamhack.se"
 )
 
-func sshLoadCertificate(c string) {
+const (
+	// Without an agent, ssh still finds the certificate next to the key.
+	sshAgentRequired = false
+	sshAgentFix      = "start one with: eval $(ssh-agent)"
+)
+
+func showWarning(msg string) {
+	log.Print(msg)
+}
+
+func showError(msg string) {
+	log.Print(msg)
+}
+
+// openAgent connects to the SSH agent, tests replace it with a fake.
+var openAgent = sshagent.FromEnv
+
+func sshPublicKeyPath() string {
+	return os.ExpandEnv(*sshPubKey)
+}
+
+func sshPrivateKeyPath() string {
+	return strings.TrimSuffix(os.ExpandEnv(*sshCert), "-cert.pub")
+}
+
+// sshAddEncryptedKey leaves the passphrase prompt to ssh-add, which loads
+// the certificate next to the key as well.
+func sshAddEncryptedKey(kp string) error {
+	c := exec.Command("/usr/bin/env", "ssh-add", kp)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stderr
+	c.Stderr = os.Stderr
+	return c.Run()
+}
+
+// sshInstallCertificate writes the certificate next to the key and makes
+// OpenSSH trust the servers signed by our CA.
+func sshInstallCertificate(c string) error {
+	errs := errorList{}
 	cp := os.ExpandEnv(*sshCert)
 	err := ioutil.WriteFile(cp, []byte(c), 0644)
 	if err != nil {
-		log.Printf("failed to write SSH certificate: %v", err)
+		errs = append(errs, fmt.Errorf("failed to write SSH certificate: %v", err))
 	}
 
-	// Add cert authority to known_hosts
-	path := os.ExpandEnv(*sshKnownHosts)
-	kh, err := ioutil.ReadFile(path)
-	if err != nil {
-		log.Printf("failed to read SSH known hosts: %v", err)
-	} else {
-		if !strings.Contains(string(kh), certAuthority) {
-			log.Printf("adding server identity to SSH known hosts")
-			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
-			if err != nil {
-				log.Printf("failed to open SSH known hosts file for writing: %v", err)
-			}
-			defer f.Close()
-			if _, err = f.WriteString(certAuthority); err != nil {
-				log.Printf("failed to write to SSH known hosts file: %v", err)
-			}
-		} else {
-			log.Printf("skipping SSH known hosts, already exists")
-		}
+	if err := sshTrustCertAuthority(); err != nil {
+		errs = append(errs, err)
 	}
 
-	// OpenSSH requires adding the private key again to load certificates
-	pp := strings.TrimSuffix(cp, "-cert.pub")
-	exec.Command("/usr/bin/env", "ssh-add", pp).Run()
+	if *wslSSHAgent != "" && isWSL() {
+		if err := forwardSSHCertificateToWindows(c); err != nil {
+			errs = append(errs, fmt.Errorf("failed to load SSH certificate into Windows agent: %v", err))
+		}
+	}
+	return errs.asError()
 }
 
-func sshGetPublicKey() (string, error) {
-	key, err := ioutil.ReadFile(os.ExpandEnv(*sshPubKey))
+// sshTrustCertAuthority adds the cert authority to known_hosts.
+func sshTrustCertAuthority() error {
+	path := os.ExpandEnv(*sshKnownHosts)
+	kh, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read SSH known hosts: %v", err)
+	}
+	if strings.Contains(string(kh), certAuthority) {
+		log.Printf("skipping SSH known hosts, already exists")
+		return nil
+	}
+	log.Printf("adding server identity to SSH known hosts")
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		log.Printf("could not read SSH public key: %v", err)
-		return "", err
+		return fmt.Errorf("failed to open SSH known hosts file for writing: %v", err)
 	}
-	return string(key), nil
+	defer f.Close()
+	if _, err = f.WriteString(certAuthority); err != nil {
+		return fmt.Errorf("failed to write to SSH known hosts file: %v", err)
+	}
+	return nil
+}
+
+func agentBridge(backend string) error {
+	return fmt.Errorf("agent-bridge is only available on Windows")
 }
 
-func saveVaultToken(t string) {
+func saveVaultToken(t string) error {
 	tp := os.ExpandEnv(*vaultTokenPath)
 	os.Remove(tp)
 	err := ioutil.WriteFile(tp, []byte(t), 0400)
 	if err != nil {
-		log.Printf("failed to write Vault token: %v", err)
+		return fmt.Errorf("failed to write Vault token: %v", err)
 	}
+	return nil
 }
 
-func hasKubectl() bool {
-	_, err := exec.LookPath("kubectl")
+// writePfx writes the certificate c with the key k to fp as a PKCS#12 file
+// without password. args are passed on to openssl.
+func writePfx(c string, k string, fp string, args ...string) error {
+	cf, err := ioutil.TempFile("", "prodaccess")
 	if err != nil {
-		return false
+		return err
 	}
-	return true
-}
-
-func saveKubernetesCertificate(c string, k string) {
-	cf, _ := ioutil.TempFile("", "prodaccess-k8s")
-	kf, _ := ioutil.TempFile("", "prodaccess-k8s")
+	defer os.Remove(cf.Name())
+	kf, err := ioutil.TempFile("", "prodaccess")
+	if err != nil {
+		cf.Close()
+		return err
+	}
+	defer os.Remove(kf.Name())
 	cf.Write([]byte(c))
 	kf.Write([]byte(k))
-	cp := cf.Name()
-	kp := kf.Name()
 	cf.Close()
 	kf.Close()
 
-	exec.Command("/usr/bin/env", "kubectl", "config", "set-credentials",
-		"dhtech", "--embed-certs=true",
-		fmt.Sprintf("--client-certificate=%s", cp),
-		fmt.Sprintf("--client-key=%s", kp)).Run()
-	os.Remove(cp)
-	os.Remove(kp)
+	os.Remove(fp)
+	f, err := os.OpenFile(fp, os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	cmd := append([]string{"openssl", "pkcs12", "-export", "-password", "pass:"}, args...)
+	_, err = executeWithStdout(append(cmd, "-in", cf.Name(), "-inkey", kf.Name(), "-out", fp)...)
+	return err
 }
 
-func saveVmwareCertificate(c string, k string) {
-	cf, _ := ioutil.TempFile("", "prodaccess-vmware")
-	kf, _ := ioutil.TempFile("", "prodaccess-vmware")
-	cf.Write([]byte(c))
-	kf.Write([]byte(k))
-	cp := cf.Name()
-	kp := kf.Name()
-	defer os.Remove(cp)	
-	defer os.Remove(kp)
-	cf.Close()
-	kf.Close()
-
+func saveVmwareCertificate(c string, k string) error {
 	fp := os.ExpandEnv(*vmwareCertPath)
-	os.Remove(fp)
-	os.OpenFile(fp, os.O_CREATE, 0600)
-	executeWithStdout("openssl", "pkcs12", "-export", "-password", "pass:", "-in", cp, "-inkey", kp, "-out", fp)
+	if err := writePfx(c, k, fp); err != nil {
+		return fmt.Errorf("failed to write VMware certificate: %v", err)
+	}
 	if isWSL() {
 		if err := importCertFromWSL(fp); err != nil {
-			log.Printf("Failed to import certificate: %v", err)
+			return fmt.Errorf("failed to import VMware certificate into Windows: %v", err)
 		}
 	}
+	return nil
 }
 
-func saveBrowserCertificate(c string, k string) {
-	cf, _ := ioutil.TempFile("", "prodaccess-browser")
-	kf, _ := ioutil.TempFile("", "prodaccess-browser")
-	cf.Write([]byte(c))
-	kf.Write([]byte(k))
-	cp := cf.Name()
-	kp := kf.Name()
-	defer os.Remove(cp)
-	defer os.Remove(kp)
-	cf.Close()
-	kf.Close()
-
+func saveBrowserCertificate(c string, k string) error {
 	fp := os.ExpandEnv(*browserCertPath)
-	os.Remove(fp)
-	os.OpenFile(fp, os.O_CREATE, 0600)
-	executeWithStdout("openssl", "pkcs12", "-export", "-password", "pass:", "-in", cp, "-inkey", kp, "-out", fp)
+	if err := writePfx(c, k, fp, "-name", browserCertName); err != nil {
+		return fmt.Errorf("failed to write browser certificate: %v", err)
+	}
+	errs := errorList{}
+	if err := importCertToNSS(fp); err != nil {
+		errs = append(errs, fmt.Errorf("failed to import browser certificate: %v", err))
+	}
 	if isWSL() {
 		if err := importCertFromWSL(fp); err != nil {
-			log.Printf("Failed to import certificate: %v", err)
+			errs = append(errs, fmt.Errorf("failed to import browser certificate into Windows: %v", err))
+		}
+	}
+	return errs.asError()
+}
+
+// browserCertificateExpiry returns when the browser certificate written by a
+// previous run expires.
+func browserCertificateExpiry() (time.Time, error) {
+	return pfxExpiry(os.ExpandEnv(*browserCertPath))
+}
+
+func pfxExpiry(fp string) (time.Time, error) {
+	if _, err := os.Stat(fp); err != nil {
+		return time.Time{}, err
+	}
+	o, err := executeWithStdout("openssl", "pkcs12", "-in", fp, "-nokeys", "-passin", "pass:")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return pemCertExpiry([]byte(o))
+}
+
+func sshCertFileExpiry(fp string) (time.Time, error) {
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return time.Time{}, err
+	}
+	k, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return time.Time{}, err
+	}
+	cert, ok := k.(*ssh.Certificate)
+	if !ok || cert.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}, fmt.Errorf("%s is not an expiring SSH certificate", fp)
+	}
+	return time.Unix(int64(cert.ValidBefore), 0), nil
+}
+
+func platformStatuses() []credentialStatus {
+	return []credentialStatus{
+		fileStatus("ssh", os.ExpandEnv(*sshCert), sshCertFileExpiry),
+		fileStatus("vmware", os.ExpandEnv(*vmwareCertPath), pfxExpiry),
+		fileStatus("browser", os.ExpandEnv(*browserCertPath), pfxExpiry),
+	}
+}
+
+func removePlatform(remove removePolicy) {
+	removeFile(os.ExpandEnv(*sshCert), sshCertFileExpiry, remove)
+	removeFile(os.ExpandEnv(*vmwareCertPath), pfxExpiry, remove)
+	removeFile(os.ExpandEnv(*browserCertPath), pfxExpiry, remove)
+
+	if a, err := openAgent(); err == nil {
+		removeAgentCertificates(a, remove)
+		a.Close()
+	}
+
+	for _, db := range nssDatabaseList() {
+		removeNSS(db, remove)
+	}
+
+	if isWSL() {
+		if err := purgeWSL(wsl.New(), remove); err != nil {
+			log.Printf("could not purge Windows certificate store: %v", err)
 		}
 	}
 }
 
-func isWSL() bool {	
-	u := unix.Utsname{}	
-	_ = unix.Uname(&u)	
-	return strings.Contains(string(u.Release[:]), "Microsoft")	
-}	
+func isWSL() bool {
+	return wsl.Detect() != wsl.None
+}
 
 func executeWithStdout(cmd ...string) (string, error) {	
 	return executeWithStdoutWithStdin("", cmd...)	
@@ -176,43 +272,209 @@ func executeWithStdoutWithStdin(stdin string, cmd ...string) (string, error) {
 	return stdout.String(), nil
 }
 
-func executeWithStdin(stdin string, cmd ...string) error {
-	_, err := executeWithStdoutWithStdin(stdin, cmd...)
-	return err
-}
-
 // If running under WSL invoke PowerShell to import certificate
 func importCertFromWSL(pfx string) error {
-	winpath, err := executeWithStdout("powershell.exe", "echo $env:TEMP")
+	w := wsl.New()
+	certs, err := w.ImportPfx(pfx)
 	if err != nil {
 		return err
 	}
+	for _, c := range certs {
+		log.Printf("Imported certificate %s (%s), valid until %v", c.Subject, c.Thumbprint, c.NotAfter)
+	}
+
+	wslImportedMu.Lock()
+	err = saveWSLImported(append(loadWSLImported(), certs...))
+	wslImportedMu.Unlock()
+	if err != nil {
+		log.Printf("could not record the imported certificates, logout will not remove them: %v", err)
+	}
+
+	return purgeWSL(w, expired)
+}
 
-	winpath = strings.Trim(winpath, "\r\n")
-	winparts := strings.Split(winpath, "\\")
-	drive := strings.ToLower(winparts[0][:1])
-	winparts = winparts[1:]
-	temppath := path.Join("/mnt", drive, path.Join(winparts...), "prodaccess.pfx")
+// wslImportedMu serializes updates of the record of imported certificates,
+// the VMware and browser certificates are installed concurrently.
+var wslImportedMu sync.Mutex
 
-	pfxdata, err := ioutil.ReadFile(pfx)
+// wslImportedPath is where the certificates imported into the Windows store
+// are recorded, so that logout can remove them.
+func wslImportedPath() string {
+	d, err := os.UserCacheDir()
 	if err != nil {
+		return "prodaccess-wsl-certificates.json"
+	}
+	return filepath.Join(d, "prodaccess", "wsl-certificates.json")
+}
+
+func loadWSLImported() []wsl.Certificate {
+	certs := []wsl.Certificate{}
+	if b, err := ioutil.ReadFile(wslImportedPath()); err == nil {
+		json.Unmarshal(b, &certs)
+	}
+	return certs
+}
+
+func saveWSLImported(certs []wsl.Certificate) error {
+	b, err := json.Marshal(certs)
+	if err != nil {
+		return err
+	}
+	fp := wslImportedPath()
+	if err := os.MkdirAll(filepath.Dir(fp), 0700); err != nil {
 		return err
 	}
+	return ioutil.WriteFile(fp, b, 0600)
+}
 
-	err = ioutil.WriteFile(temppath, pfxdata, 0644)
+// purgeWSL removes the certificates prodaccess imported into the Windows
+// store that remove selects, and any expired client certificate.
+func purgeWSL(w *wsl.Interop, remove removePolicy) error {
+	wslImportedMu.Lock()
+	defer wslImportedMu.Unlock()
+	keep := []wsl.Certificate{}
+	thumbprints := []string{}
+	for _, c := range loadWSLImported() {
+		if remove(c.NotAfter) {
+			thumbprints = append(thumbprints, c.Thumbprint)
+		} else {
+			keep = append(keep, c)
+		}
+	}
+	certs, err := w.Remove(thumbprints)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(temppath)
+	for _, c := range certs {
+		removed(fmt.Sprintf("certificate %s (%s) in the Windows store", c.Subject, c.Thumbprint), c.NotAfter)
+	}
+	if err := saveWSLImported(keep); err != nil {
+		return err
+	}
 
-	ps := fmt.Sprintf(psImport, winpath+"\\prodaccess.pfx")
-	fmt.Printf("%s\n", ps)
-	o, err := executeWithStdoutWithStdin(ps, "powershell.exe", "-Command", "-")
+	certs, err = w.PurgeExpired()
 	if err != nil {
 		return err
 	}
+	for _, c := range certs {
+		removed(fmt.Sprintf("expired certificate %s (%s) in the Windows store", c.Subject, c.Thumbprint), c.NotAfter)
+	}
+	return nil
+}
 
-	log.Printf("Imported certificate: %s", o)
+func platformEnv() []envVar {
+	vs := []envVar{}
+	if s := os.Getenv("SSH_AUTH_SOCK"); s != "" {
+		vs = append(vs, envVar{"SSH_AUTH_SOCK", s})
+	}
+	vs = append(vs,
+		envVar{"PRODACCESS_SSH_CERT", os.ExpandEnv(*sshCert)},
+		envVar{"PRODACCESS_BROWSER_CERT", os.ExpandEnv(*browserCertPath)},
+		envVar{"PRODACCESS_VMWARE_CERT", os.ExpandEnv(*vmwareCertPath)})
+	return vs
+}
+
+func platformPaths(kind string) []string {
+	switch kind {
+	case "ssh":
+		return []string{os.ExpandEnv(*sshCert)}
+	case "vmware":
+		return []string{os.ExpandEnv(*vmwareCertPath)}
+	case "browser":
+		return append([]string{os.ExpandEnv(*browserCertPath)}, nssDatabaseList()...)
+	}
+	return nil
+}
+
+func platformChanges(kind string) []plannedChange {
+	cs := []plannedChange{}
+	add := func(target string, action string) {
+		cs = append(cs, plannedChange{kind, target, action})
+	}
+	wsl := isWSL()
+	switch kind {
+	case "ssh":
+		add(os.ExpandEnv(*sshCert), "write certificate")
+		kh, _ := ioutil.ReadFile(os.ExpandEnv(*sshKnownHosts))
+		if !strings.Contains(string(kh), certAuthority) {
+			add(os.ExpandEnv(*sshKnownHosts), "append "+strings.Join(strings.Fields(certAuthority)[:3], " "))
+		}
+		if *wslSSHAgent != "" && wsl {
+			add("Windows SSH agent", "add certificate")
+		}
+	case "vmware":
+		add(os.ExpandEnv(*vmwareCertPath), "write certificate and key")
+		if wsl {
+			add("Windows certificate store", "import VMware certificate")
+		}
+	case "browser":
+		add(os.ExpandEnv(*browserCertPath), "write certificate and key")
+		for _, db := range nssDatabaseList() {
+			add(db, fmt.Sprintf("import certificate %q", browserCertName))
+		}
+		if wsl {
+			add("Windows certificate store", "import browser certificate")
+		}
+	}
+	return cs
+}
+
+func platformChecks() []check {
+	cs := []check{
+		{"known_hosts", checkKnownHosts},
+		{"openssl", checkOpenssl},
+	}
+	if len(nssDatabaseList()) > 0 {
+		cs = append(cs, check{"NSS tools", checkNSSTools})
+	}
+	if *wslSSHAgent != "" && isWSL() {
+		cs = append(cs, check{"WSL agent bridge", checkWSLBridge})
+	}
+	return cs
+}
+
+func checkKnownHosts() checkResult {
+	path := os.ExpandEnv(*sshKnownHosts)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Dir(path)); err != nil {
+			return failed(fmt.Sprintf("%s does not exist", filepath.Dir(path)), fmt.Sprintf("mkdir -m 700 %s", filepath.Dir(path)))
+		}
+		return passed(fmt.Sprintf("%s will be created", path))
+	} else if err != nil {
+		return failed(fmt.Sprintf("%s is not writable: %v", path, err), fmt.Sprintf("chmod u+w %s", path))
+	}
+	f.Close()
+	return passed(path)
+}
+
+// checkOpenssl checks for the openssl used to write VMware and browser
+// certificates, it is only required if one of them would be requested.
+func checkOpenssl() checkResult {
+	p, err := exec.LookPath("openssl")
+	if err == nil {
+		return passed(p)
+	}
+	if *requestVmware || hasBrowserProfile() {
+		return failed("openssl not found in PATH", "install openssl")
+	}
+	return warned("openssl not found in PATH, VMware and browser certificates cannot be installed", "install openssl")
+}
 
-	return executeWithStdin(psPurge, "powershell.exe", "-Command", "-")
-}
\ No newline at end of file
+func checkNSSTools() checkResult {
+	for _, t := range []string{"certutil", "pk12util"} {
+		if _, err := exec.LookPath(t); err != nil {
+			return failed(fmt.Sprintf("%s not found in PATH, needed for the browser certificate", t),
+				"install the NSS tools, libnss3-tools on Debian and Ubuntu or nss-tools on Fedora")
+		}
+	}
+	return passed(fmt.Sprintf("%d browser databases", len(nssDatabaseList())))
+}
+
+func checkWSLBridge() checkResult {
+	p, err := exec.LookPath(*wslBridge)
+	if err != nil {
+		return failed(fmt.Sprintf("%s not found: %v", *wslBridge, err), "put the Windows prodaccess.exe in PATH or set -wsl_bridge")
+	}
+	return passed(p)
+}
@@ -6,18 +6,17 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
-	"os/exec"
-	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
-	"github.com/dhtech/prodaccess/pageant"
+	"github.com/dhtech/prodaccess/sshagent"
 )
 
 var (
 	vaultTokenPath  = flag.String("vault_token", "$USERPROFILE\\.vault-token", "Path to Vault token to update.")
+	sshKey          = flag.String("sshkey", "$USERPROFILE\\.ssh\\id_ecdsa", "OpenSSH private key to load certificates with, for Pageant releases with certificate support")
 
 	MB_OK               = 0x00000000
 	MB_ICONHAND         = 0x00000010
@@ -44,84 +43,92 @@ func showError(msg string) {
 		uintptr(MB_OK | MB_ICONHAND))
 }
 
-func sshGetPublicKey() (string, error) {
-	if !pageant.Available() {
-		showWarning("No pageant detected, will not request SSH certificate")
-		return "", fmt.Errorf("no pageant")
-	}
+const (
+	// There is nowhere else to put the certificate on Windows.
+	sshAgentRequired = true
+	sshAgentFix      = "start Pageant and load your key into it"
+)
 
-	keys, err := pageant.New().List()
-	if err != nil {
-		showWarning("Failed to get keys from Pageant")
-		return "", fmt.Errorf("no pageant")
-	}
+// openAgent connects to Pageant, tests replace it with a fake.
+var openAgent = sshagent.Pageant
 
-	// Pick the first non-certificate key
-	for _, key := range keys {
-		if strings.Contains(key.Type(), "-cert-v01@openssh.com") {
-			continue
-		}
-		// Our hacked pageant only supports certificates of ECDSA for now
-		if !strings.Contains(key.Type(), "ecdsa-sha2-nistp") {
-			continue
-		}
-		return key.String(), nil
-	}
+func sshPublicKeyPath() string {
+	return os.ExpandEnv(*sshKey) + ".pub"
+}
 
-	showWarning("Did not find any signable ECDSA keys in your Pageant, will not request SSH certificate")
-	return "", fmt.Errorf("no keys found")
+func sshPrivateKeyPath() string {
+	return os.ExpandEnv(*sshKey)
 }
 
-func sshLoadCertificate(c string) {
-	if !pageant.Available() {
-		return
+func sshAddEncryptedKey(kp string) error {
+	return fmt.Errorf("%s is encrypted, load it into Pageant instead", kp)
+}
+
+func sshInstallCertificate(c string) error {
+	return nil
+}
+
+func platformStatuses() []credentialStatus {
+	s := credentialStatus{Kind: "ssh", Location: "Pageant"}
+	if a, err := openAgent(); err == nil {
+		s.Expiry, s.Installed = agentCertificateExpiry(a)
+		a.Close()
 	}
+	return []credentialStatus{s}
+}
 
-	err := pageant.New().LoadHackCertificate(c)
-	if err != nil {
-		showError(fmt.Sprintf("Failed to add key to Pageant: %v", err))
-		return
+func removePlatform(remove removePolicy) {
+	if a, err := openAgent(); err == nil {
+		removeAgentCertificates(a, remove)
+		a.Close()
 	}
 }
 
-func saveVaultToken(t string) {
+// session needs an SSH agent of its own, but Pageant is shared by everything
+// on the desktop.
+func session(argv []string) error {
+	return fmt.Errorf("credential sessions are not supported on Windows")
+}
+
+// The SSH certificate is in Pageant, which needs no environment.
+func platformEnv() []envVar {
+	return nil
+}
+
+func platformPaths(kind string) []string {
+	return nil
+}
+
+// Only Pageant is changed for SSH, and the certificates are not implemented.
+func platformChanges(kind string) []plannedChange {
+	return nil
+}
+
+func platformChecks() []check {
+	return nil
+}
+
+func saveVaultToken(t string) error {
 	tp := os.ExpandEnv(*vaultTokenPath)
 	err := ioutil.WriteFile(tp, []byte(t), 0400)
 	if err != nil {
-		log.Printf("failed to write Vault token: %v", err)
+		return fmt.Errorf("failed to write Vault token: %v", err)
 	}
+	return nil
 }
 
-func hasKubectl() bool {
-	_, err := exec.LookPath("kubectl")
-	if err != nil {
-		return false
-	}
-	return true
+func saveBrowserCertificate(c string, k string) error {
+	return fmt.Errorf("browser certificates are not implemented on Windows")
 }
 
-func saveKubernetesCertificate(c string, k string) {
-	cf, _ := ioutil.TempFile("", "prodaccess-k8s")
-	kf, _ := ioutil.TempFile("", "prodaccess-k8s")
-	cf.Write([]byte(c))
-	kf.Write([]byte(k))
-	cp := cf.Name()
-	kp := kf.Name()
-	cf.Close()
-	kf.Close()
-
-	exec.Command("kubectl", "config", "set-credentials",
-		"dhtech", "--embed-certs=true",
-		fmt.Sprintf("--client-certificate=%s", cp),
-		fmt.Sprintf("--client-key=%s", kp)).Run()
-	os.Remove(cp)
-	os.Remove(kp)
+func browserCertificateExpiry() (time.Time, error) {
+	return time.Time{}, fmt.Errorf("browser certificates are not implemented")
 }
 
-func saveBrowserCertificate(c string, k string) {
-	log.Printf("saveBrowserCertificate not implemented")
+func hasBrowserProfile() bool {
+	return false
 }
 
-func saveVmwareCertificate(c string, k string) {
-	log.Printf("saveVmwareCertificate not implemented")
+func saveVmwareCertificate(c string, k string) error {
+	return fmt.Errorf("VMware certificates are not implemented on Windows")
 }
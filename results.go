@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	pb "github.com/dhtech/proto/auth"
+	"golang.org/x/crypto/ssh"
+)
+
+// Exit statuses, documented in the usage.
+const (
+	exitFailed        = 1
+	exitUsage         = 2
+	exitNotIssued     = 3
+	exitInstallFailed = 4
+)
+
+var (
+	reportPath = flag.String("report", "", "Write the result for each credential as JSON to this file, - for stdout unless -output=json prints it there already")
+
+	credentialKinds = []string{"ssh", "vault", "kubernetes", "vmware", "browser"}
+)
+
+// credentialResult is what became of one kind of credential in a login.
+type credentialResult struct {
+	Kind string `json:"kind"`
+	// Not requested because the installed one is still valid.
+	Valid     bool   `json:"valid,omitempty"`
+	Requested bool   `json:"requested"`
+	Issued    bool   `json:"issued"`
+	Installed bool   `json:"installed"`
+	Error     string `json:"error,omitempty"`
+	// Why it was not requested, which is not a failure.
+	Skipped string `json:"skipped,omitempty"`
+
+	Paths       []string   `json:"paths,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+}
+
+func (c credentialResult) state() string {
+	switch {
+	case c.Valid:
+		return "still valid"
+	case c.Skipped != "":
+		return "skipped"
+	case c.Installed:
+		return "installed"
+	case c.Issued:
+		return "install failed"
+	case c.Requested && c.Error == "":
+		return "not issued"
+	}
+	return "failed"
+}
+
+type loginReport struct {
+	// URLs of the actions the server required.
+	RequiredActions []string           `json:"required_actions,omitempty"`
+	Credentials     []credentialResult `json:"credentials"`
+	// Set if the request failed as a whole.
+	Error string `json:"error,omitempty"`
+	// With -export_env, the environment "prodaccess env" prints.
+	Environment map[string]string `json:"environment,omitempty"`
+}
+
+func requested(ucr *pb.UserCredentialRequest, kind string) bool {
+	switch kind {
+	case "ssh":
+		return ucr.SshCertificateRequest != nil
+	case "vault":
+		return ucr.VaultTokenRequest != nil
+	case "kubernetes":
+		return ucr.KubernetesCertificateRequest != nil
+	case "vmware":
+		return ucr.VmwareCertificateRequest != nil
+	case "browser":
+		return ucr.BrowserCertificateRequest != nil
+	}
+	return false
+}
+
+func issued(r *pb.CredentialResponse, kind string) bool {
+	switch kind {
+	case "ssh":
+		return r.SshCertificate != nil
+	case "vault":
+		return r.VaultToken != nil
+	case "kubernetes":
+		return r.KubernetesCertificate != nil
+	case "vmware":
+		return r.VmwareCertificate != nil
+	case "browser":
+		return r.BrowserCertificate != nil
+	}
+	return false
+}
+
+// newLoginReport returns the results for the credentials in want. ucr and
+// response are nil if the request could not be made, installErrs has an
+// entry for every credential installed.
+func newLoginReport(want credentialSet, ucr *pb.UserCredentialRequest, response *pb.CredentialResponse, installErrs map[string]error) *loginReport {
+	r := &loginReport{}
+	for _, k := range credentialKinds {
+		if !want.has(k) {
+			continue
+		}
+		c := credentialResult{Kind: k}
+		if ucr != nil {
+			c.Requested = requested(ucr, k)
+		}
+		if response != nil {
+			c.Issued = issued(response, k)
+		}
+		if c.Issued {
+			c.describeIssued(response)
+		}
+		if err, ok := installErrs[k]; ok {
+			c.Installed = err == nil
+			if err != nil {
+				c.Error = err.Error()
+			}
+		}
+		if c.Installed {
+			c.Paths = credentialPaths(k)
+		}
+		if ucr != nil && !c.Requested {
+			c.Skipped = "no key to request it for"
+		}
+		r.Credentials = append(r.Credentials, c)
+	}
+	return r
+}
+
+// addValid adds the credentials that were not requested as they are still
+// valid.
+func (r *loginReport) addValid(kinds credentialSet) {
+	if !kinds.any() {
+		return
+	}
+	for _, s := range credentialStatuses() {
+		if !kinds.has(s.Kind) {
+			continue
+		}
+		c := credentialResult{Kind: s.Kind, Valid: true, Paths: credentialPaths(s.Kind)}
+		if !s.Expiry.IsZero() {
+			exp := s.Expiry
+			c.NotAfter = &exp
+		}
+		r.Credentials = append(r.Credentials, c)
+	}
+	index := map[string]int{}
+	for i, k := range credentialKinds {
+		index[k] = i
+	}
+	sort.SliceStable(r.Credentials, func(i, j int) bool {
+		return index[r.Credentials[i].Kind] < index[r.Credentials[j].Kind]
+	})
+}
+
+func (r *loginReport) exitCode() int {
+	if r.Error != "" {
+		return exitFailed
+	}
+	code := 0
+	for _, c := range r.Credentials {
+		switch c.state() {
+		case "install failed":
+			return exitInstallFailed
+		case "not issued", "failed":
+			code = exitNotIssued
+		}
+	}
+	return code
+}
+
+// err returns an error telling what failed, if anything did.
+func (r *loginReport) err() error {
+	if r.Error != "" {
+		return fmt.Errorf("%s", r.Error)
+	}
+	errs := errorList{}
+	for _, c := range r.Credentials {
+		switch c.state() {
+		case "install failed", "not issued", "failed":
+			errs = append(errs, fmt.Errorf("%s %s: %s", c.Kind, c.state(), c.Error))
+		}
+	}
+	return errs.asError()
+}
+
+func (r *loginReport) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, c := range r.Credentials {
+		fmt.Fprintf(tw, "%s\t%s\t%s%s\n", c.Kind, c.state(), c.Error, c.Skipped)
+	}
+	tw.Flush()
+	if r.Error != "" {
+		fmt.Fprintf(w, "login failed: %s\n", r.Error)
+	}
+}
+
+// finishReport prints the summary to stderr and writes the report to
+// -report, and to stdout with -output=json. It returns the exit status for
+// the report.
+func finishReport(r *loginReport) error {
+	r.print(os.Stderr)
+	if jsonOutput() {
+		if err := writeJSON(r); err != nil {
+			return err
+		}
+	}
+	if *reportPath != "" {
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if *reportPath == "-" {
+			os.Stdout.Write(b)
+		} else if err := ioutil.WriteFile(os.ExpandEnv(*reportPath), b, 0644); err != nil {
+			return fmt.Errorf("could not write report: %v", err)
+		}
+	}
+	if c := r.exitCode(); c != 0 {
+		return exitStatus(c)
+	}
+	return nil
+}
+
+// describeIssued sets the fingerprint and validity of the credential issued
+// in r.
+func (c *credentialResult) describeIssued(r *pb.CredentialResponse) {
+	cert := ""
+	switch c.Kind {
+	case "ssh":
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.SshCertificate.Certificate))
+		if err != nil {
+			return
+		}
+		sc, ok := k.(*ssh.Certificate)
+		if !ok {
+			return
+		}
+		c.Fingerprint = ssh.FingerprintSHA256(sc.Key)
+		nb := time.Unix(int64(sc.ValidAfter), 0)
+		c.NotBefore = &nb
+		if sc.ValidBefore != ssh.CertTimeInfinity {
+			na := time.Unix(int64(sc.ValidBefore), 0)
+			c.NotAfter = &na
+		}
+		return
+	case "kubernetes":
+		cert = r.KubernetesCertificate.Certificate
+	case "vmware":
+		cert = r.VmwareCertificate.Certificate
+	case "browser":
+		cert = r.BrowserCertificate.Certificate
+	default:
+		return
+	}
+	xc, err := pemCertificate([]byte(cert))
+	if err != nil {
+		return
+	}
+	c.Fingerprint = x509Fingerprint(xc.Raw)
+	c.NotBefore = &xc.NotBefore
+	c.NotAfter = &xc.NotAfter
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	pb "github.com/dhtech/proto/auth"
+)
+
+func TestLoginReportExitCode(t *testing.T) {
+	want := credentialSet{SSH: true, Vault: true}
+	// No SSH key to request a certificate for.
+	ucr := &pb.UserCredentialRequest{VaultTokenRequest: &pb.VaultTokenRequest{}}
+
+	r := newLoginReport(want, ucr, &pb.CredentialResponse{VaultToken: &pb.VaultToken{Token: "t"}}, map[string]error{"vault": nil})
+	if c := r.exitCode(); c != 0 {
+		t.Errorf("exit code with SSH skipped = %d, want 0", c)
+	}
+	if s := r.Credentials[0].state(); s != "skipped" {
+		t.Errorf("SSH is %q, want skipped", s)
+	}
+	if err := r.err(); err != nil {
+		t.Errorf("err() = %v with SSH skipped", err)
+	}
+
+	r = newLoginReport(want, ucr, &pb.CredentialResponse{}, map[string]error{})
+	if c := r.exitCode(); c != exitNotIssued {
+		t.Errorf("exit code without the Vault token = %d, want %d", c, exitNotIssued)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	pb "github.com/dhtech/proto/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+var (
+	authTokenFile  = flag.String("auth_token_file", "", "File with a service account token to authenticate with instead of the browser, $PRODACCESS_AUTH_TOKEN is used if empty")
+	clientCertPath = flag.String("client_cert", "", "Client certificate to authenticate with instead of the browser")
+	clientKeyPath  = flag.String("client_key", "", "Private key for -client_cert, if not in the same file")
+)
+
+// serviceAccount returns true if credentials are requested with a
+// pre-provisioned credential instead of a user in a browser. Required
+// actions cannot be followed then, so they fail the request.
+func serviceAccount() bool {
+	return *authTokenFile != "" || os.Getenv("PRODACCESS_AUTH_TOKEN") != "" || *clientCertPath != ""
+}
+
+func authToken() (string, error) {
+	if *authTokenFile == "" {
+		return os.Getenv("PRODACCESS_AUTH_TOKEN"), nil
+	}
+	b, err := ioutil.ReadFile(os.ExpandEnv(*authTokenFile))
+	if err != nil {
+		return "", fmt.Errorf("could not read service account token: %v", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// serviceAccountContext adds the service account token, if any, to the
+// metadata of requests made with ctx.
+func serviceAccountContext(ctx context.Context) (context.Context, error) {
+	t, err := authToken()
+	if err != nil || t == "" {
+		return ctx, err
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+t), nil
+}
+
+func clientCertificates() ([]tls.Certificate, error) {
+	if *clientCertPath == "" {
+		return nil, nil
+	}
+	cp := os.ExpandEnv(*clientCertPath)
+	kp := cp
+	if *clientKeyPath != "" {
+		kp = os.ExpandEnv(*clientKeyPath)
+	}
+	c, err := tls.LoadX509KeyPair(cp, kp)
+	if err != nil {
+		return nil, fmt.Errorf("could not load client certificate: %v", err)
+	}
+	return []tls.Certificate{c}, nil
+}
+
+// writeOutput writes a credential to the file fp, or to stdout if fp is "-".
+func writeOutput(fp string, data string) error {
+	if !strings.HasSuffix(data, "\n") {
+		data += "\n"
+	}
+	if fp == "-" {
+		_, err := os.Stdout.WriteString(data)
+		return err
+	}
+	fp = os.ExpandEnv(fp)
+	os.Remove(fp)
+	return ioutil.WriteFile(fp, []byte(data), 0600)
+}
+
+// fetchResult is what fetch did with one credential, for -output=json.
+type fetchResult struct {
+	Kind string `json:"kind"`
+	// Where it was written, empty if it was not.
+	Path string `json:"path,omitempty"`
+	// The credential itself when its output is stdout, which carries the
+	// JSON document instead.
+	Credential string `json:"credential,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// fetch requests the credentials that have an output and writes them there
+// as they are, without installing them anywhere else.
+func fetch(sshOut string, vaultOut string, kubeOut string) error {
+	ucr := &pb.UserCredentialRequest{}
+	if sshOut != "" {
+		pk, err := ioutil.ReadFile(sshPublicKeyPath())
+		if err != nil {
+			return fmt.Errorf("could not read SSH public key: %v", err)
+		}
+		ucr.SshCertificateRequest = &pb.SshCertificateRequest{
+			PublicKey: string(pk),
+		}
+	}
+	if vaultOut != "" {
+		ucr.VaultTokenRequest = &pb.VaultTokenRequest{}
+	}
+	if kubeOut != "" {
+		ucr.KubernetesCertificateRequest = &pb.KubernetesCertificateRequest{}
+	}
+	if ucr.SshCertificateRequest == nil && ucr.VaultTokenRequest == nil && ucr.KubernetesCertificateRequest == nil {
+		return fmt.Errorf("nothing to fetch, give at least one of -ssh_out, -vault_out or -kube_out")
+	}
+
+	response, err := requestCredentials(ucr, nil)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	results := []fetchResult{}
+	write := func(kind string, fp string, data string) {
+		if jsonOutput() && fp == "-" {
+			results = append(results, fetchResult{Kind: kind, Credential: data})
+			return
+		}
+		if err := writeOutput(fp, data); err != nil {
+			log.Printf("could not write %s credential: %v", kind, err)
+			results = append(results, fetchResult{Kind: kind, Error: err.Error()})
+			failed++
+			return
+		}
+		results = append(results, fetchResult{Kind: kind, Path: os.ExpandEnv(fp)})
+	}
+	missing := func(kind string) {
+		log.Printf("no %s credential was issued", kind)
+		results = append(results, fetchResult{Kind: kind, Error: "not issued"})
+		failed++
+	}
+	if sshOut != "" {
+		if response.SshCertificate != nil {
+			write("SSH", sshOut, response.SshCertificate.Certificate)
+		} else {
+			missing("SSH")
+		}
+	}
+	if vaultOut != "" {
+		if response.VaultToken != nil {
+			write("Vault", vaultOut, response.VaultToken.Token)
+		} else {
+			missing("Vault")
+		}
+	}
+	if kubeOut != "" {
+		if kc := response.KubernetesCertificate; kc != nil {
+			write("Kubernetes", kubeOut, kc.Certificate+"\n"+kc.PrivateKey)
+		} else {
+			missing("Kubernetes")
+		}
+	}
+	if jsonOutput() {
+		if err := writeJSON(struct {
+			Fetched []fetchResult `json:"fetched"`
+		}{results}); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d credentials were not written", failed)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+// +build freebsd linux darwin
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// session runs argv, or a shell if it is empty, with credentials that only
+// it can use. They are issued for a new SSH key held by an agent private to
+// the session and written to a temporary directory, which is removed when
+// the command exits.
+func session(argv []string) error {
+	if len(argv) == 0 {
+		sh := os.Getenv("SHELL")
+		if sh == "" {
+			sh = "/bin/sh"
+		}
+		argv = []string{sh}
+	}
+	want := credentialSet{
+		SSH:        true,
+		Vault:      true,
+		Kubernetes: wantKubernetesCertificate(),
+	}
+
+	dir, err := ioutil.TempDir("", "prodaccess-session")
+	if err != nil {
+		return err
+	}
+	keyring := agent.NewKeyring()
+	// The private key must not be left behind, also not when prodaccess
+	// exits on a fatal error or is interrupted while logging in.
+	cleanup := func() {
+		keyring.RemoveAll()
+		os.RemoveAll(dir)
+	}
+	atExit(cleanup)
+	defer cleanup()
+
+	// Interrupts are for the command once it runs, prodaccess stays to
+	// clean up after it.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	procs := make(chan *os.Process, 1)
+	go func() {
+		var p *os.Process
+		for {
+			select {
+			case p = <-procs:
+			case s := <-sigs:
+				if p == nil {
+					log.Printf("Interrupted, removing %s", dir)
+					exit(exitFailed)
+				}
+				if s != os.Interrupt {
+					p.Signal(s)
+				}
+			}
+		}
+	}()
+
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return fmt.Errorf("could not start SSH agent: %v", err)
+	}
+	defer l.Close()
+	go serveAgent(l, keyring)
+
+	if err := sessionKey(dir); err != nil {
+		return fmt.Errorf("could not create SSH key: %v", err)
+	}
+	if err := sessionKubeconfig(filepath.Join(dir, "kubeconfig")); err != nil {
+		return fmt.Errorf("could not create kubeconfig: %v", err)
+	}
+	os.Setenv("SSH_AUTH_SOCK", sock)
+	os.Setenv("KUBECONFIG", filepath.Join(dir, "kubeconfig"))
+	// Everything login writes goes to dir. Expired credentials of the user
+	// are left for the next login or gc outside the session.
+	sessionMode = true
+	userKnownHosts := os.ExpandEnv(*sshKnownHosts)
+	for k, v := range map[string]string{
+		"sshpubkey":             filepath.Join(dir, "id_ecdsa.pub"),
+		"sshcert":               filepath.Join(dir, "id_ecdsa-cert.pub"),
+		"sshknownhosts":         filepath.Join(dir, "known_hosts"),
+		"vault_token":           filepath.Join(dir, "vault-token"),
+		"kube_credential_cache": filepath.Join(dir, "kube-credential.pem"),
+		"kube_exec":             "false",
+		"wsl_ssh_agent":         "",
+	} {
+		if err := flag.Set(k, v); err != nil {
+			return err
+		}
+	}
+
+	if err := login(want).err(); err != nil {
+		return err
+	}
+	// A later login must not stop the session.
+	stopIdentServer()
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	for _, v := range environment() {
+		cmd.Env = append(cmd.Env, v.Name+"="+v.Value)
+	}
+	cmd.Env = append(cmd.Env, "PRODACCESS_SESSION="+dir)
+	// The CA is only trusted in the session's known_hosts, which ssh only
+	// reads with the session's ssh_config. git is given it through
+	// GIT_SSH_COMMAND.
+	sc := filepath.Join(dir, "ssh_config")
+	if err := sessionSSHConfig(sc, userKnownHosts, filepath.Join(dir, "known_hosts")); err != nil {
+		return fmt.Errorf("could not create ssh_config: %v", err)
+	}
+	gitSSH := os.Getenv("GIT_SSH_COMMAND")
+	if gitSSH == "" {
+		gitSSH = "ssh"
+	}
+	cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND="+gitSSH+" -F '"+strings.Replace(sc, "'", `'\''`, -1)+"'")
+
+	log.Printf("Starting %s with session credentials in %s", argv[0], dir)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	procs <- cmd.Process
+	err = cmd.Wait()
+	log.Printf("Session ended, removing %s", dir)
+	if e, ok := err.(*exec.ExitError); ok {
+		return exitStatus(e.ExitCode())
+	}
+	return err
+}
+
+func serveAgent(l net.Listener, a agent.Agent) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			agent.ServeAgent(a, c)
+			c.Close()
+		}()
+	}
+}
+
+// sessionKey writes a new key pair for the session certificate to dir.
+func sessionKey(dir string) error {
+	k, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		return err
+	}
+	pk, err := ssh.NewPublicKey(&k.PublicKey)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "id_ecdsa"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "id_ecdsa.pub"), ssh.MarshalAuthorizedKey(pk), 0644)
+}
+
+// sessionSSHConfig writes an ssh_config to fp that trusts the hosts in both
+// known_hosts files and otherwise uses the user's ssh_config.
+func sessionSSHConfig(fp string, userKnownHosts string, knownHosts string) error {
+	c := fmt.Sprintf("UserKnownHostsFile \"%s\" \"%s\"\nInclude \"%s\"\n",
+		userKnownHosts, knownHosts, os.ExpandEnv("$HOME/.ssh/config"))
+	return ioutil.WriteFile(fp, []byte(c), 0644)
+}
+
+// sessionKubeconfig writes a kubeconfig with the cluster and context from
+// the user's kubeconfig, and no credentials, to fp.
+func sessionKubeconfig(fp string) error {
+	cfg := clientcmdapi.NewConfig()
+	if uc, err := clientcmd.NewDefaultPathOptions().GetStartingConfig(); err == nil {
+		if c, ok := uc.Clusters[*kubeCluster]; ok {
+			cfg.Clusters[*kubeCluster] = c
+		}
+		if c, ok := uc.Contexts[*kubeContext]; ok {
+			cfg.Contexts[*kubeContext] = c
+			cfg.CurrentContext = *kubeContext
+		}
+	}
+	return clientcmd.WriteToFile(*cfg, fp)
+}
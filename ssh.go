@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dhtech/prodaccess/sshagent"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshGetPublicKey returns the public key to request a certificate for. Agents
+// that can only certify keys they already hold pick the key, otherwise it is
+// the one next to the private key the certificate will be loaded with.
+func sshGetPublicKey() (string, error) {
+	a, err := openAgent()
+	if err != nil && sshAgentRequired {
+		showWarning(fmt.Sprintf("No SSH agent detected (%v), will not request SSH certificate", err))
+		return "", err
+	}
+	if err == nil {
+		defer a.Close()
+		if a.Capabilities().CertificateOnly {
+			return sshAgentPublicKey(a)
+		}
+	}
+
+	key, err := ioutil.ReadFile(sshPublicKeyPath())
+	if err != nil {
+		showWarning(fmt.Sprintf("could not read SSH public key: %v", err))
+		return "", err
+	}
+	return string(key), nil
+}
+
+// sshAgentPublicKey returns the first key in a that a certificate can be
+// loaded for.
+func sshAgentPublicKey(a sshagent.Agent) (string, error) {
+	keys, err := a.List()
+	if err != nil {
+		showWarning("Failed to get keys from the SSH agent")
+		return "", err
+	}
+
+	caps := a.Capabilities()
+	// Pick the first non-certificate key
+	for _, key := range keys {
+		if strings.HasSuffix(key.Type(), "-cert-v01@openssh.com") {
+			continue
+		}
+		if !caps.Supports(key.Type()) {
+			continue
+		}
+		return key.String(), nil
+	}
+
+	showWarning("Did not find any signable keys in your SSH agent, will not request SSH certificate")
+	return "", fmt.Errorf("no keys found")
+}
+
+func sshLoadCertificate(c string) error {
+	errs := errorList{}
+	if err := sshInstallCertificate(c); err != nil {
+		errs = append(errs, err)
+	}
+
+	a, err := openAgent()
+	if err != nil {
+		if sshAgentRequired {
+			showError(fmt.Sprintf("Failed to connect to SSH agent: %v", err))
+			return append(errs, fmt.Errorf("failed to connect to SSH agent: %v", err))
+		}
+		log.Printf("not loading SSH certificate into agent: %v", err)
+		return errs.asError()
+	}
+	defer a.Close()
+
+	err = sshAddCertificate(a, c, sshPrivateKeyPath())
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		err = sshAddEncryptedKey(sshPrivateKeyPath())
+	}
+	if err != nil {
+		showError(fmt.Sprintf("Failed to add SSH certificate to agent: %v", err))
+		errs = append(errs, fmt.Errorf("failed to add SSH certificate to agent: %v", err))
+	}
+	return errs.asError()
+}
+
+// sshAddCertificate loads the certificate c into a, together with the
+// private key in kp unless the agent already holds it.
+func sshAddCertificate(a sshagent.Agent, c string, kp string) error {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c))
+	if err != nil {
+		return fmt.Errorf("could not parse SSH certificate: %v", err)
+	}
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("not an SSH certificate")
+	}
+
+	var key interface{}
+	if !a.Capabilities().CertificateOnly {
+		kb, err := ioutil.ReadFile(os.ExpandEnv(kp))
+		if err != nil {
+			return err
+		}
+		key, err = ssh.ParseRawPrivateKey(kb)
+		if err != nil {
+			return err
+		}
+	}
+
+	lifetime := time.Duration(0)
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		lifetime = time.Until(time.Unix(int64(cert.ValidBefore), 0))
+	}
+	return a.AddCertificate(cert, key, lifetime)
+}
+
+// agentCertificateExpiry returns the expiry of the longest valid certificate
+// for our key in a, and whether there is one.
+func agentCertificateExpiry(a sshagent.Agent) (time.Time, bool) {
+	keys, err := a.List()
+	if err != nil {
+		return time.Time{}, false
+	}
+	own := sshOwnKey()
+	exp := time.Time{}
+	found := false
+	for _, key := range keys {
+		pk, err := ssh.ParsePublicKey(key.Blob)
+		if err != nil {
+			continue
+		}
+		cert, ok := pk.(*ssh.Certificate)
+		if !ok || (own != nil && !bytes.Equal(cert.Key.Marshal(), own.Marshal())) {
+			continue
+		}
+		found = true
+		if e := time.Unix(int64(cert.ValidBefore), 0); e.After(exp) {
+			exp = e
+		}
+	}
+	return exp, found
+}
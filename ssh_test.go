@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dhtech/prodaccess/sshagent"
+	"golang.org/x/crypto/ssh"
+)
+
+// withAgent makes openAgent return a, and the home directory a temporary
+// one, until the returned function is called.
+func withAgent(t *testing.T, a sshagent.Agent) func() {
+	td, err := ioutil.TempDir("", "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(td, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	oldOpen, oldHome, oldProfile := openAgent, os.Getenv("HOME"), os.Getenv("USERPROFILE")
+	openAgent = func() (sshagent.Agent, error) {
+		if a == nil {
+			return nil, sshagent.ErrNoAgent
+		}
+		return a, nil
+	}
+	os.Setenv("HOME", td)
+	os.Setenv("USERPROFILE", td)
+	return func() {
+		openAgent = oldOpen
+		os.Setenv("HOME", oldHome)
+		os.Setenv("USERPROFILE", oldProfile)
+		os.RemoveAll(td)
+	}
+}
+
+func testECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// testSSHCertificate returns a certificate for key in authorized_keys
+// format, valid until validBefore.
+func testSSHCertificate(t *testing.T, key interface{}, validBefore uint64) (*ssh.Certificate, string) {
+	pub, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(testECDSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:         pub.PublicKey(),
+		CertType:    ssh.UserCert,
+		KeyId:       "test",
+		ValidBefore: validBefore,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert, string(ssh.MarshalAuthorizedKey(cert))
+}
+
+// writeSSHKey writes key where prodaccess looks for the user's key pair.
+func writeSSHKey(t *testing.T, key *ecdsa.PrivateKey) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sshPrivateKeyPath(), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sshPublicKeyPath(), ssh.MarshalAuthorizedKey(pk), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func hasAgentCertificate(t *testing.T, a sshagent.Agent, cert *ssh.Certificate) bool {
+	keys, err := a.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if bytes.Equal(k.Blob, cert.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+var ecdsaOnly = sshagent.Capabilities{
+	CertificateOnly: true,
+	KeyTypes:        []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521},
+}
+
+func TestSSHGetPublicKeyFromAgent(t *testing.T) {
+	f := sshagent.NewFake(ecdsaOnly)
+	defer withAgent(t, f)()
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddKey(ed, "ed25519"); err != nil {
+		t.Fatal(err)
+	}
+	k := testECDSAKey(t)
+	if err := f.AddKey(k, "ecdsa"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := sshGetPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := ssh.NewPublicKey(&k.PublicKey)
+	if !bytes.Equal(got.Marshal(), want.Marshal()) {
+		t.Errorf("sshGetPublicKey = %s, want the ECDSA key", got.Type())
+	}
+}
+
+func TestSSHGetPublicKeyRejectsUnsupportedType(t *testing.T) {
+	f := sshagent.NewFake(ecdsaOnly)
+	defer withAgent(t, f)()
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddKey(ed, "ed25519"); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := sshGetPublicKey(); err == nil {
+		t.Errorf("sshGetPublicKey = %q for an agent with only an unsupported key", s)
+	}
+}
+
+func TestSSHGetPublicKeyFromFile(t *testing.T) {
+	defer withAgent(t, sshagent.NewFake(sshagent.Capabilities{}))()
+	k := testECDSAKey(t)
+	writeSSHKey(t, k)
+
+	s, err := sshGetPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := ssh.NewPublicKey(&k.PublicKey)
+	if s != string(ssh.MarshalAuthorizedKey(want)) {
+		t.Errorf("sshGetPublicKey = %q, want the key file", s)
+	}
+}
+
+func TestSSHAddCertificateLifetime(t *testing.T) {
+	f := sshagent.NewFake(sshagent.Capabilities{})
+	defer withAgent(t, f)()
+	k := testECDSAKey(t)
+	writeSSHKey(t, k)
+
+	cert, c := testSSHCertificate(t, k, uint64(time.Now().Add(time.Hour).Unix()))
+	if err := sshAddCertificate(f, c, sshPrivateKeyPath()); err != nil {
+		t.Fatal(err)
+	}
+	if !hasAgentCertificate(t, f, cert) {
+		t.Error("certificate not in the agent")
+	}
+	_, c = testSSHCertificate(t, k, ssh.CertTimeInfinity)
+	if err := sshAddCertificate(f, c, sshPrivateKeyPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.Lifetimes) != 2 {
+		t.Fatalf("added %d certificates, want 2", len(f.Lifetimes))
+	}
+	if l := f.Lifetimes[0]; l <= 59*time.Minute || l > time.Hour {
+		t.Errorf("lifetime is %v, want until the certificate expires", l)
+	}
+	if l := f.Lifetimes[1]; l != 0 {
+		t.Errorf("lifetime of a certificate that never expires is %v, want none", l)
+	}
+}
+
+func TestSSHAddCertificateRejectsUnsupportedType(t *testing.T) {
+	f := sshagent.NewFake(ecdsaOnly)
+	defer withAgent(t, f)()
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c := testSSHCertificate(t, ed, ssh.CertTimeInfinity)
+	if err := sshAddCertificate(f, c, sshPrivateKeyPath()); err == nil {
+		t.Error("ECDSA-only agent accepted an Ed25519 certificate")
+	}
+}
+
+func TestSSHLoadCertificate(t *testing.T) {
+	f := sshagent.NewFake(ecdsaOnly)
+	defer withAgent(t, f)()
+	k := testECDSAKey(t)
+	if err := f.AddKey(k, "ecdsa"); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, c := testSSHCertificate(t, k, uint64(time.Now().Add(time.Hour).Unix()))
+	if err := sshLoadCertificate(c); err != nil {
+		t.Fatal(err)
+	}
+	if !hasAgentCertificate(t, f, cert) {
+		t.Error("certificate not in the agent")
+	}
+}
+
+func TestSSHLoadCertificateWithoutAgent(t *testing.T) {
+	defer withAgent(t, nil)()
+	k := testECDSAKey(t)
+	_, c := testSSHCertificate(t, k, uint64(time.Now().Add(time.Hour).Unix()))
+	err := sshLoadCertificate(c)
+	if sshAgentRequired && err == nil {
+		t.Error("loaded a certificate without the required agent")
+	}
+	if !sshAgentRequired && err != nil {
+		t.Errorf("sshLoadCertificate without an agent: %v", err)
+	}
+}
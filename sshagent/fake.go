@@ -0,0 +1,78 @@
+package sshagent
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Fake is an in-memory Agent with configurable capabilities.
+type Fake struct {
+	Caps    Capabilities
+	keyring agent.Agent
+	// Certificates added without their private key.
+	certs []*ssh.Certificate
+	// Lifetimes holds the lifetime of every certificate added, in order.
+	Lifetimes []time.Duration
+}
+
+// NewFake returns an empty Fake agent with the given capabilities.
+func NewFake(caps Capabilities) *Fake {
+	return &Fake{Caps: caps, keyring: agent.NewKeyring()}
+}
+
+// AddKey adds a plain private key, as a user would with ssh-add.
+func (f *Fake) AddKey(key interface{}, comment string) error {
+	return f.keyring.Add(agent.AddedKey{PrivateKey: key, Comment: comment})
+}
+
+func (f *Fake) List() ([]*agent.Key, error) {
+	keys, err := f.keyring.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range f.certs {
+		keys = append(keys, &agent.Key{Format: c.Type(), Blob: c.Marshal(), Comment: c.KeyId})
+	}
+	return keys, nil
+}
+
+func (f *Fake) AddCertificate(cert *ssh.Certificate, key interface{}, lifetime time.Duration) error {
+	if !f.Caps.Supports(cert.Key.Type()) {
+		return errors.New("key type not supported")
+	}
+	f.Lifetimes = append(f.Lifetimes, lifetime)
+	if key != nil {
+		return f.keyring.Add(agent.AddedKey{
+			PrivateKey:   key,
+			Certificate:  cert,
+			Comment:      cert.KeyId,
+			LifetimeSecs: lifetimeSecs(lifetime),
+		})
+	}
+	if !f.Caps.CertificateOnly {
+		return ErrPrivateKeyRequired
+	}
+	f.certs = append(f.certs, cert)
+	return nil
+}
+
+func (f *Fake) Remove(key ssh.PublicKey) error {
+	for i, c := range f.certs {
+		if string(c.Marshal()) == string(key.Marshal()) {
+			f.certs = append(f.certs[:i], f.certs[i+1:]...)
+			return nil
+		}
+	}
+	return f.keyring.Remove(key)
+}
+
+func (f *Fake) Capabilities() Capabilities {
+	return f.Caps
+}
+
+func (f *Fake) Close() error {
+	return nil
+}
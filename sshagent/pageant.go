@@ -0,0 +1,69 @@
+package sshagent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/dhtech/prodaccess/pageant"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrKeyNotHeld is returned when our patched Pageant is asked to load a
+// certificate for a key it does not hold, which it would accept but not use.
+var ErrKeyNotHeld = errors.New("Pageant does not hold the key of the certificate")
+
+// pageantAgent is Pageant, which is either a release loading certificates
+// the OpenSSH way or our patched build that needs the hack format.
+type pageantAgent struct {
+	client
+	rw   io.ReadWriter
+	caps pageant.Capabilities
+}
+
+// NewPageant returns an Agent for a Pageant reached through rw, which takes
+// raw length prefixed agent messages. Close closes c, which may be nil.
+func NewPageant(rw io.ReadWriter, c io.Closer) Agent {
+	a := agent.NewClient(rw)
+	return &pageantAgent{client: client{a, c}, rw: rw, caps: pageant.QueryCapabilities(a)}
+}
+
+func (p *pageantAgent) AddCertificate(cert *ssh.Certificate, key interface{}, lifetime time.Duration) error {
+	if p.caps.StandardCertificates {
+		return p.client.AddCertificate(cert, key, lifetime)
+	}
+	// Our patched Pageant has no lifetime constraint, the certificate stays
+	// until it is garbage collected.
+	keys, err := p.List()
+	if err != nil {
+		return fmt.Errorf("could not list Pageant keys: %v", err)
+	}
+	held := false
+	for _, k := range keys {
+		held = held || bytes.Equal(k.Blob, cert.Key.Marshal())
+	}
+	if !held {
+		return ErrKeyNotHeld
+	}
+	c := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))) + " " + cert.KeyId
+	return pageant.WriteHackCertificate(p.rw, c)
+}
+
+func (p *pageantAgent) Capabilities() Capabilities {
+	if p.caps.StandardCertificates {
+		return Capabilities{}
+	}
+	// Our hacked pageant only supports certificates of ECDSA for now
+	return Capabilities{
+		CertificateOnly: true,
+		KeyTypes: []string{
+			ssh.KeyAlgoECDSA256,
+			ssh.KeyAlgoECDSA384,
+			ssh.KeyAlgoECDSA521,
+		},
+	}
+}
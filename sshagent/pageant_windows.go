@@ -0,0 +1,15 @@
+// +build windows
+
+package sshagent
+
+import (
+	"github.com/dhtech/prodaccess/pageant"
+)
+
+// Pageant returns the Pageant running for the current user.
+func Pageant() (Agent, error) {
+	if !pageant.Available() {
+		return nil, pageant.ErrPageantNotFound
+	}
+	return NewPageant(pageant.NewConn(), nil), nil
+}
@@ -0,0 +1,124 @@
+// Package sshagent provides one interface to the different SSH agents
+// prodaccess loads certificates into.
+package sshagent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	ErrNoAgent            = errors.New("no SSH agent running")
+	ErrPrivateKeyRequired = errors.New("agent needs the private key to add a certificate")
+)
+
+// Capabilities describes how certificates can be loaded into an agent.
+type Capabilities struct {
+	// CertificateOnly is true if a certificate can be added for a key the
+	// agent already holds, without passing the private key.
+	CertificateOnly bool
+	// KeyTypes limits the key types certificates can be added for, nil
+	// means any type.
+	KeyTypes []string
+}
+
+// Supports returns true if certificates can be added for keys of type t.
+func (c Capabilities) Supports(t string) bool {
+	if c.KeyTypes == nil {
+		return true
+	}
+	for _, kt := range c.KeyTypes {
+		if kt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Agent is an SSH agent that certificates can be loaded into.
+type Agent interface {
+	// List returns the identities held by the agent.
+	List() ([]*agent.Key, error)
+	// AddCertificate adds cert, expiring from the agent after lifetime. The
+	// private key may be nil if the agent has the CertificateOnly capability.
+	AddCertificate(cert *ssh.Certificate, key interface{}, lifetime time.Duration) error
+	// Remove removes the identity with the given public key.
+	Remove(key ssh.PublicKey) error
+	Capabilities() Capabilities
+	Close() error
+}
+
+// client is an agent speaking the OpenSSH agent protocol.
+type client struct {
+	a agent.ExtendedAgent
+	c io.Closer
+}
+
+// New returns an Agent speaking the OpenSSH agent protocol over rw. Close
+// closes c, which may be nil.
+func New(rw io.ReadWriter, c io.Closer) Agent {
+	return &client{agent.NewClient(rw), c}
+}
+
+// Dial connects to the agent listening on the unix socket sock.
+func Dial(sock string) (Agent, error) {
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to SSH agent: %v", err)
+	}
+	return New(c, c), nil
+}
+
+// FromEnv connects to the agent in $SSH_AUTH_SOCK.
+func FromEnv() (Agent, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, ErrNoAgent
+	}
+	return Dial(sock)
+}
+
+func (c *client) List() ([]*agent.Key, error) {
+	return c.a.List()
+}
+
+func (c *client) AddCertificate(cert *ssh.Certificate, key interface{}, lifetime time.Duration) error {
+	if key == nil {
+		return ErrPrivateKeyRequired
+	}
+	return c.a.Add(agent.AddedKey{
+		PrivateKey:   key,
+		Certificate:  cert,
+		Comment:      cert.KeyId,
+		LifetimeSecs: lifetimeSecs(lifetime),
+	})
+}
+
+func (c *client) Remove(key ssh.PublicKey) error {
+	return c.a.Remove(key)
+}
+
+func (c *client) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+func (c *client) Close() error {
+	if c.c == nil {
+		return nil
+	}
+	return c.c.Close()
+}
+
+func lifetimeSecs(d time.Duration) uint32 {
+	if d <= 0 {
+		return 0
+	}
+	return uint32(d / time.Second)
+}
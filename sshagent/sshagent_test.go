@@ -0,0 +1,191 @@
+package sshagent
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func testCertificate(t *testing.T, key interface{}) *ssh.Certificate {
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:         signer.PublicKey(),
+		CertType:    ssh.UserCert,
+		KeyId:       "test",
+		ValidBefore: uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func ecdsaKey(t *testing.T) *ecdsa.PrivateKey {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func hasCertificate(t *testing.T, a Agent, cert *ssh.Certificate) bool {
+	keys, err := a.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	for _, k := range keys {
+		if bytes.Equal(k.Blob, cert.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClient(t *testing.T) {
+	c, s := net.Pipe()
+	defer s.Close()
+	go agent.ServeAgent(agent.NewKeyring(), s)
+	a := New(c, c)
+	defer a.Close()
+
+	k := ecdsaKey(t)
+	cert := testCertificate(t, k)
+	if err := a.AddCertificate(cert, nil, time.Hour); err != ErrPrivateKeyRequired {
+		t.Errorf("AddCertificate without key = %v, want %v", err, ErrPrivateKeyRequired)
+	}
+	if err := a.AddCertificate(cert, k, time.Hour); err != nil {
+		t.Fatalf("AddCertificate: %v", err)
+	}
+	if !hasCertificate(t, a, cert) {
+		t.Errorf("certificate not listed after AddCertificate")
+	}
+	if err := a.Remove(cert); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if hasCertificate(t, a, cert) {
+		t.Errorf("certificate listed after Remove")
+	}
+}
+
+// legacyPageant answers every request like our patched Pageant: it knows
+// no extensions, lists keys and accepts any add identity request.
+type legacyPageant struct {
+	keys  []ssh.PublicKey
+	reqs  [][]byte
+	reply bytes.Buffer
+}
+
+func (p *legacyPageant) Write(b []byte) (int, error) {
+	p.reqs = append(p.reqs, append([]byte(nil), b...))
+	if b[4] == 11 { // SSH2_AGENTC_REQUEST_IDENTITIES
+		var ids bytes.Buffer
+		ids.WriteByte(12) // SSH2_AGENT_IDENTITIES_ANSWER
+		binary.Write(&ids, binary.BigEndian, uint32(len(p.keys)))
+		for _, k := range p.keys {
+			ids.Write(ssh.Marshal(struct {
+				Blob    []byte
+				Comment string
+			}{k.Marshal(), "key"}))
+		}
+		binary.Write(&p.reply, binary.BigEndian, uint32(ids.Len()))
+		p.reply.Write(ids.Bytes())
+		return len(b), nil
+	}
+	status := byte(6) // SSH_AGENT_SUCCESS
+	if b[4] == 27 {   // SSH_AGENTC_EXTENSION
+		status = 5 // SSH_AGENT_FAILURE
+	}
+	binary.Write(&p.reply, binary.BigEndian, uint32(1))
+	p.reply.WriteByte(status)
+	return len(b), nil
+}
+
+func (p *legacyPageant) Read(b []byte) (int, error) {
+	return p.reply.Read(b)
+}
+
+func TestLegacyPageant(t *testing.T) {
+	cert := testCertificate(t, ecdsaKey(t))
+	p := &legacyPageant{keys: []ssh.PublicKey{cert.Key}}
+	a := NewPageant(p, nil)
+
+	caps := a.Capabilities()
+	if !caps.CertificateOnly {
+		t.Errorf("legacy Pageant is not CertificateOnly")
+	}
+	if caps.Supports(ssh.KeyAlgoED25519) || !caps.Supports(ssh.KeyAlgoECDSA256) {
+		t.Errorf("legacy Pageant should only support ECDSA keys, got %v", caps.KeyTypes)
+	}
+
+	if err := a.AddCertificate(cert, nil, time.Hour); err != nil {
+		t.Fatalf("AddCertificate: %v", err)
+	}
+	last := p.reqs[len(p.reqs)-1]
+	var msg struct {
+		Type    string `sshtype:"17"`
+		Keyblob []byte
+		Comment string
+	}
+	if err := ssh.Unmarshal(last[4:], &msg); err != nil {
+		t.Fatalf("unexpected add request: %v", err)
+	}
+	if msg.Type != cert.Type() || !bytes.Equal(msg.Keyblob, cert.Marshal()) || msg.Comment != "test" {
+		t.Errorf("add request = %+v, want certificate %s", msg, cert.Type())
+	}
+}
+
+func TestLegacyPageantWithoutKey(t *testing.T) {
+	p := &legacyPageant{keys: []ssh.PublicKey{testCertificate(t, ecdsaKey(t)).Key}}
+	a := NewPageant(p, nil)
+	sent := len(p.reqs)
+	if err := a.AddCertificate(testCertificate(t, ecdsaKey(t)), nil, time.Hour); err != ErrKeyNotHeld {
+		t.Errorf("AddCertificate for a key Pageant does not hold = %v, want ErrKeyNotHeld", err)
+	}
+	for _, r := range p.reqs[sent:] {
+		if r[4] == 17 { // SSH2_AGENTC_ADD_IDENTITY
+			t.Errorf("certificate sent although Pageant does not hold the key")
+		}
+	}
+}
+
+func TestFake(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFake(Capabilities{CertificateOnly: true, KeyTypes: []string{ssh.KeyAlgoECDSA256}})
+	if err := f.AddCertificate(testCertificate(t, edKey), nil, time.Hour); err == nil {
+		t.Errorf("Fake accepted unsupported key type")
+	}
+	cert := testCertificate(t, ecdsaKey(t))
+	if err := f.AddCertificate(cert, nil, time.Hour); err != nil {
+		t.Fatalf("AddCertificate: %v", err)
+	}
+	if !hasCertificate(t, f, cert) {
+		t.Errorf("certificate not listed after AddCertificate")
+	}
+	if err := f.Remove(cert); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if hasCertificate(t, f, cert) {
+		t.Errorf("certificate listed after Remove")
+	}
+
+	f = NewFake(Capabilities{})
+	if err := f.AddCertificate(cert, nil, time.Hour); err != ErrPrivateKeyRequired {
+		t.Errorf("AddCertificate without key = %v, want %v", err, ErrPrivateKeyRequired)
+	}
+}
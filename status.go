@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	renewBefore = flag.Duration("renew_before", time.Hour, "Renew credentials that expire within this duration")
+)
+
+// credentialStatus is the state of one kind of installed credential.
+type credentialStatus struct {
+	Kind      string
+	Location  string
+	Installed bool
+	// Zero if the credential does not tell when it expires.
+	Expiry time.Time
+}
+
+// fileStatus returns the status of a credential stored in the file fp.
+func fileStatus(kind string, fp string, expiry func(string) (time.Time, error)) credentialStatus {
+	s := credentialStatus{Kind: kind, Location: fp}
+	if _, err := os.Stat(fp); err != nil {
+		return s
+	}
+	s.Installed = true
+	if expiry != nil {
+		if exp, err := expiry(fp); err == nil {
+			s.Expiry = exp
+		}
+	}
+	return s
+}
+
+func kubernetesStatus() credentialStatus {
+	s := credentialStatus{Kind: "kubernetes", Location: os.ExpandEnv(*kubeCredentialCache)}
+	if _, _, exp, err := loadKubeCredentialCache(); err == nil {
+		s.Installed = true
+		s.Expiry = exp
+		return s
+	}
+
+	cfg, err := clientcmd.NewDefaultPathOptions().GetStartingConfig()
+	if err != nil {
+		return s
+	}
+	s.Location = fmt.Sprintf("kubeconfig user %q", *kubeUser)
+	ai, ok := cfg.AuthInfos[*kubeUser]
+	if !ok || len(ai.ClientCertificateData) == 0 {
+		return s
+	}
+	s.Installed = true
+	if exp, err := pemCertExpiry(ai.ClientCertificateData); err == nil {
+		s.Expiry = exp
+	}
+	return s
+}
+
+// credentialStatuses returns the status of every kind of credential.
+func credentialStatuses() []credentialStatus {
+	st := platformStatuses()
+	st = append(st,
+		fileStatus("vault", os.ExpandEnv(*vaultTokenPath), nil),
+		kubernetesStatus())
+	return st
+}
+
+func printStatus(w io.Writer, st []credentialStatus) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, s := range st {
+		state := "not installed"
+		switch {
+		case !s.Installed:
+		case s.Expiry.IsZero():
+			state = "installed"
+		case s.Expiry.Before(time.Now()):
+			state = fmt.Sprintf("expired %s", s.Expiry.Local().Format(time.RFC1123))
+		default:
+			state = fmt.Sprintf("valid until %s (%s)", s.Expiry.Local().Format(time.RFC1123),
+				time.Until(s.Expiry).Round(time.Minute))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Kind, state, s.Location)
+	}
+	tw.Flush()
+}
+
+func (c *credentialSet) set(kind string) {
+	switch kind {
+	case "ssh":
+		c.SSH = true
+	case "vault":
+		c.Vault = true
+	case "kubernetes":
+		c.Kubernetes = true
+	case "vmware":
+		c.VMware = true
+	case "browser":
+		c.Browser = true
+	}
+}
+
+func (c credentialSet) has(kind string) bool {
+	switch kind {
+	case "ssh":
+		return c.SSH
+	case "vault":
+		return c.Vault
+	case "kubernetes":
+		return c.Kubernetes
+	case "vmware":
+		return c.VMware
+	case "browser":
+		return c.Browser
+	}
+	return false
+}
+
+// renewWindow is how long before it expires a credential is renewed.
+func renewWindow(kind string) time.Duration {
+	if kind == "browser" && *browserRenewBefore > *renewBefore {
+		return *browserRenewBefore
+	}
+	return *renewBefore
+}
+
+// expiring returns the credentials in want that are not installed or that
+// expire within their renewal window. Credentials that do not tell when they
+// expire are only requested together with others.
+func expiring(want credentialSet) credentialSet {
+	need := credentialSet{}
+	unknown := credentialSet{}
+	for _, s := range credentialStatuses() {
+		if !want.has(s.Kind) {
+			continue
+		}
+		switch {
+		case !s.Installed:
+			need.set(s.Kind)
+		case s.Expiry.IsZero():
+			unknown.set(s.Kind)
+		case time.Until(s.Expiry) < renewWindow(s.Kind):
+			log.Printf("%s credential expires %v, renewing", s.Kind, s.Expiry.Local())
+			need.set(s.Kind)
+		}
+	}
+	if !need.any() {
+		return need
+	}
+	for _, k := range []string{"ssh", "vault", "kubernetes", "vmware", "browser"} {
+		if unknown.has(k) {
+			need.set(k)
+		}
+	}
+	return need
+}
+
+// loginCredentials returns the credentials in want to request, skipping
+// those that are still valid unless -force is given.
+func loginCredentials(want credentialSet) credentialSet {
+	if *forceRequest {
+		return want
+	}
+	want = expiring(want)
+	if !want.any() {
+		log.Printf("All credentials are still valid, use -force to renew them anyway")
+	}
+	return want
+}
+
+func loginCommand() error {
+	wanted := wantedCredentials()
+	want := loginCredentials(wanted)
+	if *dryRun {
+		return planLogin(os.Stdout, want, credentialSet{
+			SSH:        wanted.SSH && !want.SSH,
+			Vault:      wanted.Vault && !want.Vault,
+			Kubernetes: wanted.Kubernetes && !want.Kubernetes,
+			VMware:     wanted.VMware && !want.VMware,
+			Browser:    wanted.Browser && !want.Browser,
+		})
+	}
+	r := &loginReport{}
+	if want.any() {
+		r = login(want)
+	}
+	r.addValid(credentialSet{
+		SSH:        wanted.SSH && !want.SSH,
+		Vault:      wanted.Vault && !want.Vault,
+		Kubernetes: wanted.Kubernetes && !want.Kubernetes,
+		VMware:     wanted.VMware && !want.VMware,
+		Browser:    wanted.Browser && !want.Browser,
+	})
+	if *exportEnv {
+		if jsonOutput() {
+			r.Environment = envMap(environment())
+		} else if err := printEnv(os.Stdout, detectShell(), environment()); err != nil {
+			return err
+		}
+	}
+	return finishReport(r)
+}
+
+func installedCredentials() credentialSet {
+	c := credentialSet{}
+	for _, s := range credentialStatuses() {
+		if s.Installed {
+			c.set(s.Kind)
+		}
+	}
+	return c
+}
+
+// renew requests new credentials of the kinds that are installed.
+func renew() error {
+	want := installedCredentials()
+	if !want.any() {
+		return fmt.Errorf("no installed credentials to renew, use login")
+	}
+	if *dryRun {
+		return planLogin(os.Stdout, want, credentialSet{})
+	}
+	return finishReport(login(want))
+}
+
+// daemon renews the installed credentials whenever one of them is about to
+// expire.
+func daemon(interval time.Duration) error {
+	for {
+		if want := expiring(installedCredentials()); want.any() {
+			if err := login(want).err(); err != nil {
+				log.Printf("renewal failed: %v", err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (s credentialStatus) MarshalJSON() ([]byte, error) {
+	type status struct {
+		Kind      string     `json:"kind"`
+		Location  string     `json:"location"`
+		Installed bool       `json:"installed"`
+		Expiry    *time.Time `json:"expiry,omitempty"`
+	}
+	o := status{Kind: s.Kind, Location: s.Location, Installed: s.Installed}
+	if !s.Expiry.IsZero() {
+		o.Expiry = &s.Expiry
+	}
+	return json.Marshal(o)
+}
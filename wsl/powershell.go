@@ -0,0 +1,19 @@
+package wsl
+
+const (
+	// The scripts print the affected certificates as a JSON array.
+	psPurge = `
+$certs = @(Get-ChildItem -Path cert:\CurrentUser\My -Recurse -EKU "*Client Authentication*" -ExpiringInDays 0)
+$certs | Remove-Item
+ConvertTo-Json -Compress -InputObject @($certs | Select-Object Thumbprint, Subject, @{n='NotAfter';e={$_.NotAfter.ToString('o')}})
+`
+	psImport = `
+$certs = @(Import-PfxCertificate -FilePath '%s' -CertStoreLocation Cert:\CurrentUser\My)
+ConvertTo-Json -Compress -InputObject @($certs | Select-Object Thumbprint, Subject, @{n='NotAfter';e={$_.NotAfter.ToString('o')}})
+`
+	psRemove = `
+$certs = @(Get-ChildItem -Path cert:\CurrentUser\My | Where-Object { @(%s) -contains $_.Thumbprint })
+$certs | Remove-Item
+ConvertTo-Json -Compress -InputObject @($certs | Select-Object Thumbprint, Subject, @{n='NotAfter';e={$_.NotAfter.ToString('o')}})
+`
+)
@@ -0,0 +1,187 @@
+// Package wsl talks to the Windows side when running under the Windows
+// Subsystem for Linux.
+package wsl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Version is the WSL generation prodaccess is running under.
+type Version int
+
+const (
+	None Version = iota
+	WSL1
+	WSL2
+)
+
+// ParseKernelRelease returns the WSL version for a kernel release string.
+// WSL1 reports e.g. "4.4.0-19041-Microsoft" while WSL2 kernels are named like
+// "5.15.90.1-microsoft-standard-WSL2".
+func ParseKernelRelease(release string) Version {
+	r := strings.ToLower(release)
+	if !strings.Contains(r, "microsoft") {
+		return None
+	}
+	if strings.Contains(r, "microsoft-standard") || strings.Contains(r, "wsl2") {
+		return WSL2
+	}
+	return WSL1
+}
+
+// Detect returns the WSL version of the running kernel.
+func Detect() Version {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return None
+	}
+	return ParseKernelRelease(string(b))
+}
+
+// Runner runs a command with the given stdin and returns its stdout.
+type Runner interface {
+	Run(stdin string, name string, args ...string) (string, error)
+}
+
+// ExecRunner runs commands found on the PATH, which under WSL includes the
+// Windows executables.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(stdin string, name string, args ...string) (string, error) {
+	c := exec.Command(name, args...)
+	var stdout, stderr bytes.Buffer
+	c.Stdin = strings.NewReader(stdin)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// Certificate is a certificate in the Windows certificate store.
+type Certificate struct {
+	Thumbprint string
+	Subject    string
+	NotAfter   time.Time
+}
+
+// Interop runs Windows commands from inside WSL.
+type Interop struct {
+	Runner Runner
+}
+
+// New returns an Interop running the real Windows executables.
+func New() *Interop {
+	return &Interop{Runner: ExecRunner{}}
+}
+
+func (i *Interop) run(stdin string, name string, args ...string) (string, error) {
+	o, err := i.Runner.Run(stdin, name, args...)
+	// Windows tools output a BOM and CRLF line endings.
+	return strings.TrimSpace(strings.TrimPrefix(o, "\ufeff")), err
+}
+
+// PowerShell runs script in a non-interactive PowerShell.
+func (i *Interop) PowerShell(script string) (string, error) {
+	return i.run(script, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command", "-")
+}
+
+// WindowsPath translates a Linux path to the Windows path for it.
+func (i *Interop) WindowsPath(p string) (string, error) {
+	return i.run("", "wslpath", "-w", p)
+}
+
+// LinuxPath translates a Windows path to the Linux path for it.
+func (i *Interop) LinuxPath(p string) (string, error) {
+	return i.run("", "wslpath", "-u", p)
+}
+
+// TempDir returns the Linux path of the Windows user's temporary directory.
+func (i *Interop) TempDir() (string, error) {
+	w, err := i.PowerShell("[System.IO.Path]::GetTempPath()")
+	if err != nil {
+		return "", err
+	}
+	return i.LinuxPath(w)
+}
+
+// ImportPfx imports a password-less PFX file into the certificate store of
+// the Windows user. The file is copied to the Windows side first as not
+// every Linux path is reachable from Windows.
+func (i *Interop) ImportPfx(pfx string) ([]Certificate, error) {
+	b, err := ioutil.ReadFile(pfx)
+	if err != nil {
+		return nil, err
+	}
+	td, err := i.TempDir()
+	if err != nil {
+		return nil, fmt.Errorf("could not find Windows temporary directory: %v", err)
+	}
+	f, err := ioutil.TempFile(td, "prodaccess-*.pfx")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	wp, err := i.WindowsPath(filepath.Clean(f.Name()))
+	if err != nil {
+		return nil, err
+	}
+	o, err := i.PowerShell(fmt.Sprintf(psImport, strings.Replace(wp, "'", "''", -1)))
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificates(o)
+}
+
+// PurgeExpired removes expired client authentication certificates from the
+// certificate store of the Windows user.
+func (i *Interop) PurgeExpired() ([]Certificate, error) {
+	o, err := i.PowerShell(psPurge)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificates(o)
+}
+
+// Remove removes the certificates with the given thumbprints from the
+// certificate store of the Windows user.
+func (i *Interop) Remove(thumbprints []string) ([]Certificate, error) {
+	if len(thumbprints) == 0 {
+		return []Certificate{}, nil
+	}
+	q := make([]string, len(thumbprints))
+	for n, t := range thumbprints {
+		q[n] = "'" + strings.Replace(t, "'", "''", -1) + "'"
+	}
+	o, err := i.PowerShell(fmt.Sprintf(psRemove, strings.Join(q, ",")))
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificates(o)
+}
+
+func parseCertificates(o string) ([]Certificate, error) {
+	certs := []Certificate{}
+	if o == "" {
+		return certs, nil
+	}
+	if err := json.Unmarshal([]byte(o), &certs); err != nil {
+		return nil, fmt.Errorf("unexpected PowerShell output %q: %v", o, err)
+	}
+	return certs, nil
+}
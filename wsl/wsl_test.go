@@ -0,0 +1,154 @@
+package wsl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKernelRelease(t *testing.T) {
+	for _, c := range []struct {
+		release string
+		want    Version
+	}{
+		{"4.4.0-19041-Microsoft", WSL1},
+		{"4.4.0-17763-Microsoft\n", WSL1},
+		{"5.15.90.1-microsoft-standard-WSL2", WSL2},
+		{"5.10.16.3-microsoft-standard-WSL2\n", WSL2},
+		{"6.1.0-18-amd64", None},
+		{"", None},
+	} {
+		if got := ParseKernelRelease(c.release); got != c.want {
+			t.Errorf("ParseKernelRelease(%q) = %v, want %v", c.release, got, c.want)
+		}
+	}
+}
+
+func TestParseCertificates(t *testing.T) {
+	certs, err := parseCertificates(`[{"Thumbprint":"AB12","Subject":"CN=user","NotAfter":"2024-01-02T03:04:05.0000000+00:00"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if len(certs) != 1 || certs[0].Thumbprint != "AB12" || certs[0].Subject != "CN=user" || !certs[0].NotAfter.Equal(want) {
+		t.Errorf("parseCertificates = %+v", certs)
+	}
+
+	if certs, err := parseCertificates(""); err != nil || len(certs) != 0 {
+		t.Errorf("parseCertificates(\"\") = %+v, %v, want none", certs, err)
+	}
+	if _, err := parseCertificates("Import-PfxCertificate : access denied"); err == nil {
+		t.Error("parseCertificates accepted garbage")
+	}
+}
+
+// fakeRunner stands in for powershell.exe and wslpath.
+type fakeRunner struct {
+	// Linux path of the Windows temporary directory.
+	tempDir string
+	// What powershell.exe prints for scripts that are not GetTempPath.
+	output  string
+	scripts []string
+}
+
+func (r *fakeRunner) Run(stdin string, name string, args ...string) (string, error) {
+	switch name {
+	case "powershell.exe":
+		if strings.Contains(stdin, "GetTempPath") {
+			return "C:\\Users\\user\\AppData\\Local\\Temp\\\r\n", nil
+		}
+		r.scripts = append(r.scripts, stdin)
+		return "\ufeff" + r.output + "\r\n", nil
+	case "wslpath":
+		switch args[0] {
+		case "-u":
+			return r.tempDir + "\n", nil
+		case "-w":
+			return "C:\\Users\\o'user\\" + filepath.Base(args[1]) + "\n", nil
+		}
+	}
+	return "", fmt.Errorf("unexpected command %s %v", name, args)
+}
+
+const testCertificates = `[{"Thumbprint":"AB12","Subject":"CN=user","NotAfter":"2024-01-02T03:04:05.0000000+00:00"}]`
+
+func TestImportPfx(t *testing.T) {
+	td, err := ioutil.TempDir("", "wsl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	pfx := filepath.Join(td, "user.pfx")
+	if err := ioutil.WriteFile(pfx, []byte("pfx"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	windows := filepath.Join(td, "windows")
+	if err := os.Mkdir(windows, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &fakeRunner{tempDir: windows, output: testCertificates}
+	certs, err := (&Interop{Runner: r}).ImportPfx(pfx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Thumbprint != "AB12" {
+		t.Errorf("ImportPfx = %+v", certs)
+	}
+	if len(r.scripts) != 1 {
+		t.Fatalf("ran %d scripts, want 1", len(r.scripts))
+	}
+	s := r.scripts[0]
+	if !strings.Contains(s, "Import-PfxCertificate -FilePath 'C:\\Users\\o''user\\prodaccess-") {
+		t.Errorf("script does not import the quoted Windows copy:\n%s", s)
+	}
+	if !strings.Contains(s, `Cert:\CurrentUser\My`) {
+		t.Errorf("script does not import into the user store:\n%s", s)
+	}
+	left, _ := ioutil.ReadDir(windows)
+	if len(left) != 0 {
+		t.Errorf("Windows copy of the PFX was left behind: %v", left[0].Name())
+	}
+}
+
+func TestPurgeExpired(t *testing.T) {
+	r := &fakeRunner{output: testCertificates}
+	certs, err := (&Interop{Runner: r}).PurgeExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Subject != "CN=user" {
+		t.Errorf("PurgeExpired = %+v", certs)
+	}
+	if len(r.scripts) != 1 || !strings.Contains(r.scripts[0], "-ExpiringInDays 0") || !strings.Contains(r.scripts[0], "Remove-Item") {
+		t.Errorf("unexpected purge script: %q", r.scripts)
+	}
+
+	r.output = ""
+	if certs, err := (&Interop{Runner: r}).PurgeExpired(); err != nil || len(certs) != 0 {
+		t.Errorf("PurgeExpired with nothing expired = %+v, %v", certs, err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	r := &fakeRunner{output: testCertificates}
+	certs, err := (&Interop{Runner: r}).Remove([]string{"AB12", "CD'34"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Thumbprint != "AB12" {
+		t.Errorf("Remove = %+v", certs)
+	}
+	if len(r.scripts) != 1 || !strings.Contains(r.scripts[0], "@('AB12','CD''34') -contains $_.Thumbprint") {
+		t.Errorf("unexpected remove script: %q", r.scripts)
+	}
+
+	r.scripts = nil
+	if _, err := (&Interop{Runner: r}).Remove(nil); err != nil || len(r.scripts) != 0 {
+		t.Errorf("Remove(nil) ran %q, %v", r.scripts, err)
+	}
+}
@@ -0,0 +1,60 @@
+// +build freebsd linux darwin
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/dhtech/prodaccess/sshagent"
+)
+
+var (
+	wslSSHAgent = flag.String("wsl_ssh_agent", "", "When running under WSL, also load the SSH certificate into this Windows agent: pageant or openssh")
+	wslBridge   = flag.String("wsl_bridge", "prodaccess.exe", "Windows prodaccess used to reach the Windows SSH agent from WSL")
+)
+
+// forwardSSHCertificateToWindows loads the SSH certificate c into the
+// Windows side agent, relayed by "prodaccess.exe agent-bridge".
+func forwardSSHCertificateToWindows(c string) error {
+	cmd := exec.Command(*wslBridge, "agent-bridge", *wslSSHAgent)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start agent bridge: %v", err)
+	}
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{stdout, stdin}
+
+	switch *wslSSHAgent {
+	case "pageant":
+		err = sshAddCertificate(sshagent.NewPageant(rw, nil), c, sshPrivateKeyPath())
+		if err == sshagent.ErrKeyNotHeld {
+			log.Printf("Skipping Windows Pageant, it does not hold the SSH key %s. Add the key to Pageant and log in again to use the certificate from Windows",
+				sshPrivateKeyPath())
+			err = nil
+		}
+	case "openssh":
+		err = sshAddCertificate(sshagent.New(rw, nil), c, sshPrivateKeyPath())
+	default:
+		err = fmt.Errorf("unknown agent %q, expected pageant or openssh", *wslSSHAgent)
+	}
+	stdin.Close()
+	if werr := cmd.Wait(); err == nil && werr != nil {
+		err = fmt.Errorf("agent bridge failed: %v", werr)
+	}
+	return err
+}